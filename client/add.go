@@ -0,0 +1,160 @@
+package client
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cszatmary/dot/dotfile"
+	"github.com/pkg/errors"
+)
+
+// AddOptions configures how an existing file is added to the registry by Add.
+type AddOptions struct {
+	// Name is the name of the dotfile in the registry. It is required.
+	Name string
+	// SrcPath is the path of the dotfile source within the registry.
+	// If empty, it defaults to a file in a directory with the same name as the dotfile,
+	// ex: adding ~/.tmux.conf with the name tmux results in tmux/tmux.conf.
+	SrcPath string
+	// OS is the list of operating systems the dotfile supports.
+	// If empty, all operating systems are supported.
+	OS []string
+}
+
+// Add starts managing the existing file at dstPath. The file is copied into the registry
+// and a dotfile for it is added to the registry's `dot.yml`. The file is then setup
+// like Setup would, except that it is already in sync with its source so it does not
+// need to be applied.
+//
+// Only regular files can be added. If a dotfile with the same name already exists,
+// dotfile.ErrExists is returned. Like Apply, Add is atomic. If anything fails,
+// all changes to the registry are rolled back.
+func (c *Client) Add(dstPath string, opts AddOptions) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// Dotfiles are always added to the highest layer, which overrides all the others
+	layerDir := c.topLayerDir()
+	if err := c.checkWritable(layerDir); err != nil {
+		return err
+	}
+
+	if opts.Name == "" {
+		return errors.New("a name is required to add a dotfile")
+	}
+	if _, err := c.registry.Dotfiles(opts.Name); err == nil {
+		return errors.Wrap(dotfile.ErrExists, opts.Name)
+	}
+	if _, ok := c.lf.Dotfiles[opts.Name]; ok {
+		return errors.Wrapf(dotfile.ErrExists, "%s is still in the lockfile", opts.Name)
+	}
+
+	dstPath, err = filepath.Abs(expandTilde(dstPath, c.homeDir))
+	if err != nil {
+		return errors.Wrapf(err, "failed to get absolute path of %s", dstPath)
+	}
+	info, err := os.Lstat(dstPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get info of %s", dstPath)
+	}
+	if !info.Mode().IsRegular() {
+		return errors.Errorf("%s is not a regular file, only files can be added", dstPath)
+	}
+
+	df := dotfile.Dotfile{
+		Name:    opts.Name,
+		SrcPath: opts.SrcPath,
+		DstPath: c.collapseTilde(dstPath),
+		OS:      opts.OS,
+	}
+	if df.SrcPath == "" {
+		df.SrcPath = path.Join(df.Name, strings.TrimPrefix(filepath.Base(dstPath), "."))
+	}
+	if !fs.ValidPath(df.SrcPath) || strings.HasPrefix(df.SrcPath, ".") {
+		return errors.Errorf("invalid src path %q, must be relative to the registry", df.SrcPath)
+	}
+	srcPath := filepath.Join(layerDir, filepath.FromSlash(df.SrcPath))
+	if _, err := os.Lstat(srcPath); err == nil {
+		return errors.Errorf("%s already exists in the registry", df.SrcPath)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrapf(err, "failed to get info of %s", srcPath)
+	}
+
+	cfgPath := filepath.Join(layerDir, dotfile.ConfigFile)
+	cfgInfo, err := os.Stat(cfgPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get info of %s", cfgPath)
+	}
+	cfg, err := os.ReadFile(cfgPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", cfgPath)
+	}
+	cfg, err = dotfile.AddToConfig(cfg, df)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(dstPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", dstPath)
+	}
+
+	df.DstPath = dstPath
+	c.debugger.Debugf("Adding %s to the registry as %s", dstPath, df.SrcPath)
+	tx := newTransaction(c.debugger)
+	// Backup the dotfile like Setup does, so that restoring it leaves the file in place.
+	// The backup is written as part of the transaction so it is removed if adding fails.
+	idx, err := c.readBackupIndex()
+	if err != nil {
+		return err
+	}
+	backup := idx.newBackup(df.Name, BackupReasonSetup)
+	backup.Hash = hashData(defaultHashAlgo, data)
+	if err := tx.writeFile(c.backupPath(backup.Name, backup.ID), data, info.Mode().Perm()); err != nil {
+		return c.rollback(tx, errors.Wrapf(err, "failed to backup %s", df.Name))
+	}
+	idx.Backups = append(idx.Backups, backup)
+	if err := tx.snapshot(c.backupIndexPath()); err != nil {
+		return c.rollback(tx, errors.Wrapf(err, "failed to backup %s", df.Name))
+	}
+	if err := c.writeBackupIndex(idx); err != nil {
+		return c.rollback(tx, err)
+	}
+	if err := tx.writeFile(srcPath, data, info.Mode().Perm()); err != nil {
+		return c.rollback(tx, errors.Wrapf(err, "failed to add %s", df.Name))
+	}
+	if err := tx.writeFile(cfgPath, cfg, cfgInfo.Mode().Perm()); err != nil {
+		return c.rollback(tx, errors.Wrapf(err, "failed to add %s", df.Name))
+	}
+	if err := tx.writeFile(c.basePath(df.Name), data, 0o644); err != nil {
+		return c.rollback(tx, errors.Wrapf(err, "failed to add %s", df.Name))
+	}
+	registry, err := c.reopenRegistry()
+	if err != nil {
+		return c.rollback(tx, err)
+	}
+
+	dfInfo := newDotfileInfo(df)
+	dfInfo.DstHash = hashData(defaultHashAlgo, data)
+	c.lf.Dotfiles[df.Name] = dfInfo
+	if err := c.writeLockfile(); err != nil {
+		delete(c.lf.Dotfiles, df.Name)
+		return c.rollback(tx, errors.Wrap(err, "failed to save lockfile"))
+	}
+	c.registry = registry
+	return nil
+}
+
+// collapseTilde replaces the home directory at the start of p with '~',
+// which is the form destinations are usually written in `dot.yml`.
+func (c *Client) collapseTilde(p string) string {
+	rel, err := filepath.Rel(c.homeDir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return p
+	}
+	return "~/" + filepath.ToSlash(rel)
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	stderrors "errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cszatmary/dot/dotfile"
+	"github.com/cszatmary/dot/internal/archive"
+	"github.com/pkg/errors"
+)
+
+// ErrRegistryReadOnly is returned when an operation needs to modify the registry, but the registry is an archive.
+var ErrRegistryReadOnly = stderrors.New("registry is an archive and cannot be modified")
+
+// openLayer loads the registry at path, without any registries it extends. If isArchive is true,
+// path is an archive file, otherwise it is a directory. If the registry is an archive, the checksum
+// of the archive that was loaded is also returned.
+func openLayer(path string, isArchive bool) (*dotfile.Registry, string, error) {
+	if !isArchive {
+		registry, err := dotfile.NewRegistry(os.DirFS(path))
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "failed to load dot registry at %s", path)
+		}
+		return registry, "", nil
+	}
+	// Read the whole archive so the checksum is guaranteed to match the contents that were loaded
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to read registry archive %s", path)
+	}
+	fsys, err := archive.New(path, data)
+	if err != nil {
+		return nil, "", err
+	}
+	registry, err := dotfile.NewRegistry(fsys)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to load dot registry from archive %s", path)
+	}
+	return registry, hashData(hashSHA256, data), nil
+}
+
+// isHTTPURL returns whether or not s is an http or https URL.
+func isHTTPURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+// downloadArchive downloads the registry archive at url to the file at path. The archive is downloaded
+// to a temporary file and loaded along with layers first, so that path is left untouched if downloading
+// fails or the registry is invalid.
+func (c *Client) downloadArchive(url, path string, layers []string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return errors.Wrapf(err, "failed to download registry archive from %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to download registry archive from %s: got status %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "failed to download registry archive from %s", url)
+	}
+	// Keep the extension since it determines how the archive is read
+	tmp := filepath.Join(filepath.Dir(path), "registry-download"+archive.Ext(url))
+	if err := writeFileAtomic(tmp, data, 0o644); err != nil {
+		return errors.Wrapf(err, "failed to save registry archive to %s", tmp)
+	}
+	defer os.Remove(tmp)
+	if _, _, err := c.openRegistry(tmp, true, layers); err != nil {
+		return errors.Wrapf(err, "invalid registry archive downloaded from %s", url)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrapf(err, "failed to save registry archive to %s", path)
+	}
+	return nil
+}
+
+// Archive returns the path or URL of the archive the registry was loaded from,
+// or an empty string if the registry is not an archive.
+func (c *Client) Archive() string {
+	return c.lf.Archive
+}
+
+// ArchiveChanged returns whether or not the registry archive is different than the one that was
+// last applied, based on its checksum. It is also true if the archive has never been applied.
+// It is always false if the registry is not an archive.
+func (c *Client) ArchiveChanged() bool {
+	return c.lf.Archive != "" && c.archiveSum != c.lf.ArchiveSum
+}
+
+// checkWritable returns ErrRegistryReadOnly if the registry layer at dir cannot be modified.
+func (c *Client) checkWritable(dir string) error {
+	if c.isArchiveLayer(dir) {
+		return errors.Wrap(ErrRegistryReadOnly, c.lf.Archive)
+	}
+	return nil
+}
+
+// registryArchivePath returns the path that registry archives downloaded from a URL are saved to.
+func (c *Client) registryArchivePath(url string) string {
+	return filepath.Join(c.configPath(), "registry"+archive.Ext(url))
+}
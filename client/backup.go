@@ -0,0 +1,370 @@
+package client
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/cszatmary/dot/dotfile"
+	"github.com/pkg/errors"
+)
+
+// ErrBackupNotFound is returned when a backup does not exist.
+var ErrBackupNotFound = stderrors.New("backup not found")
+
+// Reasons for why a backup was created.
+const (
+	// BackupReasonSetup means the backup was created when the dotfile was setup.
+	// It contains the dotfile as it was before it was managed by dot.
+	BackupReasonSetup = "setup"
+	// BackupReasonForceApply means the backup was created because a modified dotfile
+	// was about to be overwritten by Apply in force mode.
+	BackupReasonForceApply = "force apply"
+	// BackupReasonMerge means the backup was created because a modified dotfile
+	// was about to be merged with its source by Apply.
+	BackupReasonMerge = "merge"
+	// BackupReasonRestore means the backup was created because the dotfile was about to be
+	// overwritten by restoring another backup.
+	BackupReasonRestore = "restore"
+	// BackupReasonForceRestore means the backup was created because a modified dotfile
+	// was about to be overwritten by restoring it in force mode.
+	BackupReasonForceRestore = "force restore"
+)
+
+// DefaultBackupRetention is the default maximum number of backups that are kept for each dotfile.
+const DefaultBackupRetention = 10
+
+// Backup contains information about a backup of a dotfile.
+type Backup struct {
+	// Name is the name of the dotfile that was backed up.
+	Name string `json:"name"`
+	// ID uniquely identifies the backup among the backups of the dotfile.
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// Hash is the sha256 hash of the dotfile at the time it was backed up.
+	Hash string `json:"hash"`
+	// Reason is why the backup was created, one of the BackupReason constants.
+	Reason string `json:"reason"`
+}
+
+// backupIndex contains the list of all backups. It is stored in the backups directory.
+type backupIndex struct {
+	Backups []Backup `json:"backups"`
+}
+
+func (c *Client) backupIndexPath() string {
+	return filepath.Join(c.backupsPath(), "index.json")
+}
+
+// backupPath returns the path where the backup with the given dotfile name and id is stored.
+func (c *Client) backupPath(name, id string) string {
+	return filepath.Join(c.backupsPath(), name, id)
+}
+
+// legacyBackupPath returns the path where backups were stored before backups were versioned.
+// Only a single backup, created by Setup, was kept for each dotfile.
+func (c *Client) legacyBackupPath(df dotfile.Dotfile) string {
+	return filepath.Join(c.backupsPath(), df.SrcPath) + ".bak"
+}
+
+func (c *Client) readBackupIndex() (*backupIndex, error) {
+	idx := &backupIndex{}
+	p := c.backupIndexPath()
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read backup index %s", p)
+	}
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse backup index %s", p)
+	}
+	return idx, nil
+}
+
+func (c *Client) writeBackupIndex(idx *backupIndex) error {
+	p := c.backupIndexPath()
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize backup index")
+	}
+	if err := writeFileAtomic(p, data, 0o644); err != nil {
+		return errors.Wrapf(err, "failed to write backup index %s", p)
+	}
+	return nil
+}
+
+// newBackup returns a new backup of the dotfile with the given name with an ID that is unique in idx.
+// The backup is not added to idx.
+func (idx *backupIndex) newBackup(name, reason string) Backup {
+	now := time.Now().UTC()
+	b := Backup{Name: name, Time: now, Reason: reason}
+	// Use the time as the ID since it is easy to read, add a suffix in the unlikely event of a collision
+	b.ID = now.Format("20060102150405")
+	for i := 1; ; i++ {
+		if _, ok := idx.find(b.Name, b.ID); !ok {
+			break
+		}
+		b.ID = fmt.Sprintf("%s-%d", now.Format("20060102150405"), i)
+	}
+	return b
+}
+
+// find returns the backup of the dotfile with the given name and id.
+func (idx *backupIndex) find(name, id string) (Backup, bool) {
+	for _, b := range idx.Backups {
+		if b.Name == name && b.ID == id {
+			return b, true
+		}
+	}
+	return Backup{}, false
+}
+
+// latest returns the most recent backup of the dotfile with the given name that was created for reason.
+func (idx *backupIndex) latest(name, reason string) (Backup, bool) {
+	var latest Backup
+	var found bool
+	for _, b := range idx.Backups {
+		if b.Name == name && b.Reason == reason && (!found || !b.Time.Before(latest.Time)) {
+			latest = b
+			found = true
+		}
+	}
+	return latest, found
+}
+
+// backupDotfile creates a new backup of the destination of df, which must exist, and saves it
+// in the backup index. If rels is not nil, df is a directory and only the files in rels that
+// exist are backed up. The hashes of the files that were backed up are returned in that case.
+func (c *Client) backupDotfile(df dotfile.Dotfile, reason string, rels []string) (map[string]string, error) {
+	idx, err := c.readBackupIndex()
+	if err != nil {
+		return nil, err
+	}
+	files, err := c.addBackup(idx, df, reason, rels)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.saveBackupIndex(idx, df.Name); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// addBackup is like backupDotfile but only adds the backup to idx without saving it.
+func (c *Client) addBackup(idx *backupIndex, df dotfile.Dotfile, reason string, rels []string) (map[string]string, error) {
+	dst := expandTilde(df.DstPath, c.homeDir)
+	b := idx.newBackup(df.Name, reason)
+	c.debugger.Debugf("Creating backup %s of %s", b.ID, dst)
+	backupPath := c.backupPath(b.Name, b.ID)
+	var files map[string]string
+	var err error
+	if rels != nil {
+		files, err = backupDir(dst, backupPath, rels)
+		if err != nil {
+			return nil, err
+		}
+		b.Hash = hashFiles(defaultHashAlgo, files)
+	} else {
+		b.Hash, _, err = hashDst(defaultHashAlgo, dst)
+		if err != nil {
+			return nil, err
+		}
+		if err := backupFile(dst, backupPath); err != nil {
+			return nil, errors.Wrapf(err, "failed to backup %s to %s", dst, backupPath)
+		}
+	}
+
+	idx.Backups = append(idx.Backups, b)
+	return files, nil
+}
+
+// saveBackupIndex prunes the backups of the dotfiles with the given names according
+// to the backup retention policy and then writes idx.
+func (c *Client) saveBackupIndex(idx *backupIndex, names ...string) error {
+	for _, name := range names {
+		if err := c.pruneBackups(idx, name); err != nil {
+			return err
+		}
+	}
+	return c.writeBackupIndex(idx)
+}
+
+// pruneBackups removes the oldest backups of the dotfile with the given name until the number
+// of backups is within the retention limit. The most recent setup backup is never removed since
+// it is needed to restore the dotfile to how it was before dot managed it.
+func (c *Client) pruneBackups(idx *backupIndex, name string) error {
+	if c.backupRetention <= 0 {
+		return nil
+	}
+	setup, hasSetup := idx.latest(name, BackupReasonSetup)
+	var backups []Backup
+	for _, b := range idx.Backups {
+		if b.Name == name {
+			backups = append(backups, b)
+		}
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Time.Before(backups[j].Time)
+	})
+
+	remove := make(map[string]bool)
+	for n := len(backups); n > c.backupRetention; n-- {
+		for _, b := range backups {
+			if remove[b.ID] || (hasSetup && b.ID == setup.ID) {
+				continue
+			}
+			c.debugger.Debugf("Removing old backup %s of %s", b.ID, name)
+			if err := os.RemoveAll(c.backupPath(name, b.ID)); err != nil {
+				return errors.Wrapf(err, "failed to remove backup %s of %s", b.ID, name)
+			}
+			remove[b.ID] = true
+			break
+		}
+	}
+
+	kept := idx.Backups[:0]
+	for _, b := range idx.Backups {
+		if b.Name != name || !remove[b.ID] {
+			kept = append(kept, b)
+		}
+	}
+	idx.Backups = kept
+	return nil
+}
+
+// originalBackupPath returns the path to the backup of df that was created when it was setup.
+// An empty string is returned if there is no backup, meaning the dotfile did not exist before it was setup.
+func (c *Client) originalBackupPath(df dotfile.Dotfile) (string, error) {
+	idx, err := c.readBackupIndex()
+	if err != nil {
+		return "", err
+	}
+	if b, ok := idx.latest(df.Name, BackupReasonSetup); ok {
+		return c.backupPath(b.Name, b.ID), nil
+	}
+	// Fallback to a backup created by an older version of dot
+	legacyPath := c.legacyBackupPath(df)
+	if _, err := os.Lstat(legacyPath); err == nil {
+		return legacyPath, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", errors.Wrapf(err, "failed to get info of %s", legacyPath)
+	}
+	return "", nil
+}
+
+// Backups returns the backups of the given dotfiles ordered by name and then by time.
+// If no names are provided, the backups of all dotfiles are returned.
+func (c *Client) Backups(names ...string) ([]Backup, error) {
+	idx, err := c.readBackupIndex()
+	if err != nil {
+		return nil, err
+	}
+	include := make(map[string]bool)
+	for _, name := range names {
+		include[name] = true
+	}
+	var backups []Backup
+	for _, b := range idx.Backups {
+		if len(names) == 0 || include[b.Name] {
+			backups = append(backups, b)
+		}
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		if backups[i].Name != backups[j].Name {
+			return backups[i].Name < backups[j].Name
+		}
+		return backups[i].Time.Before(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// BackupPath returns the path to the backup of the dotfile with the given name and id.
+// The path may be a file, a symlink, or a directory if the dotfile is a directory.
+func (c *Client) BackupPath(name, id string) (string, error) {
+	idx, err := c.readBackupIndex()
+	if err != nil {
+		return "", err
+	}
+	if _, ok := idx.find(name, id); !ok {
+		return "", errors.Wrapf(ErrBackupNotFound, "%s %s", name, id)
+	}
+	return c.backupPath(name, id), nil
+}
+
+// RestoreBackup restores the dotfile with the given name to the state it was in when the
+// backup with the given id was created. Before the dotfile is restored, a backup of its current
+// state is created so that the restore can be undone. The lockfile is not changed, so if the backup
+// differs from what dot last applied, the dotfile will be considered manually modified.
+func (c *Client) RestoreBackup(name, id string) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	idx, err := c.readBackupIndex()
+	if err != nil {
+		return err
+	}
+	if _, ok := idx.find(name, id); !ok {
+		return errors.Wrapf(ErrBackupNotFound, "%s %s", name, id)
+	}
+	if _, ok := c.lf.Dotfiles[name]; !ok {
+		return errors.Wrap(ErrNotSetup, name)
+	}
+	dfs, err := c.registry.Dotfiles(name)
+	if err != nil {
+		return errors.Wrap(err, "failed to get dotfiles from registry")
+	}
+	df := dfs[0]
+
+	if err := c.backupCurrent(idx, df, BackupReasonRestore); err != nil {
+		return err
+	}
+	// Save the index after restoring so the backup being restored isn't pruned first
+	tx := newTransaction(c.debugger)
+	if err := c.restoreDotfile(tx, df, c.backupPath(name, id)); err != nil {
+		err = c.rollback(tx, errors.Wrapf(err, "failed to restore backup %s of %s", id, name))
+		if saveErr := c.saveBackupIndex(idx, name); saveErr != nil {
+			return errors.Wrapf(err, "failed to save backup index: %v", saveErr)
+		}
+		return err
+	}
+	return c.saveBackupIndex(idx, name)
+}
+
+// backupCurrent adds a backup of the current destination of df to idx if it exists.
+func (c *Client) backupCurrent(idx *backupIndex, df dotfile.Dotfile, reason string) error {
+	dst := expandTilde(df.DstPath, c.homeDir)
+	info, err := os.Lstat(dst)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to get info of %s", dst)
+	}
+
+	var rels []string
+	if df.IsDir && !df.IsSymlink() && info.IsDir() {
+		// Backup all the files that are managed by dot or will be
+		rels, err = c.registry.DotfileFiles(df.Name)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get files of dotfile %s", df.Name)
+		}
+		for rel := range c.lf.Dotfiles[df.Name].Files {
+			rels = append(rels, rel)
+		}
+		// Make sure rels is non-nil so it is treated as a directory
+		if rels == nil {
+			rels = []string{}
+		}
+	}
+	_, err = c.addBackup(idx, df, reason, rels)
+	return err
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Capture copies manually modified dotfiles back to their sources in the registry, so that
+// the modifications become part of the registry and the dotfiles are no longer considered modified.
+// If no names are provided, all dotfiles that were manually modified are captured.
+// Dotfiles that were not modified are skipped.
+//
+// Templated dotfiles and dotfiles installed as symlinks cannot be captured. Dotfiles whose source
+// has also changed since they were last applied cannot be captured either, since that would
+// discard the changes to the source. They should be merged first using Apply with the Merge option.
+//
+// Like Apply, Capture is atomic. If any dotfile fails to be captured, all changes are rolled back.
+func (c *Client) Capture(names ...string) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	dfs, err := c.dotfiles(names...)
+	if err != nil {
+		return err
+	}
+	var checks []dotfileCheck
+	for _, df := range dfs {
+		reason, err := c.checkPlatform(df)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			c.debugger.Debugf("Skipping %s: %s", df.Name, reason)
+			continue
+		}
+		check, err := c.checkDotfile(df)
+		if err != nil {
+			return err
+		}
+		if !check.setup {
+			if len(names) == 0 {
+				continue
+			}
+			return errors.Wrap(ErrNotSetup, df.Name)
+		}
+		if !check.modified {
+			c.debugger.Debugf("Skipping %s since it was not modified", df.Name)
+			continue
+		}
+		if err := c.checkWritable(c.layerDir(df)); err != nil {
+			return err
+		}
+		switch {
+		case df.Template:
+			return errors.Errorf("cannot capture %s since it is a template, update the template in the registry instead", df.Name)
+		case df.IsSymlink():
+			return errors.Errorf("cannot capture %s since it is installed as a symlink and changes are made to the registry directly", df.Name)
+		case check.dstIsSymlink:
+			return errors.Errorf("cannot capture %s since %s was replaced by a symlink", df.Name, check.df.DstPath)
+		case check.outdated:
+			return errors.Errorf("cannot capture %s since its source has also changed, run 'dot apply --merge' first", df.Name)
+		}
+		checks = append(checks, check)
+	}
+
+	tx := newTransaction(c.debugger)
+	dfInfos := make(map[string]dotfileInfo)
+	for _, check := range checks {
+		c.debugger.Debugf("Capturing dotfile %s", check.df.Name)
+		var info dotfileInfo
+		var err error
+		if check.df.IsDir {
+			info, err = c.captureDir(tx, check)
+		} else {
+			info, err = c.captureFile(tx, check)
+		}
+		if err != nil {
+			return c.rollback(tx, errors.Wrapf(err, "failed to capture %s", check.df.Name))
+		}
+		dfInfos[check.df.Name] = info
+	}
+
+	prevInfos := make(map[string]dotfileInfo)
+	for name, info := range dfInfos {
+		prevInfos[name] = c.lf.Dotfiles[name]
+		c.lf.Dotfiles[name] = info
+	}
+	if err := c.writeLockfile(); err != nil {
+		for name, info := range prevInfos {
+			c.lf.Dotfiles[name] = info
+		}
+		return c.rollback(tx, errors.Wrap(err, "failed to save lockfile"))
+	}
+	return nil
+}
+
+// captureFile copies the destination of the dotfile in check to its source as part of tx.
+// It returns the new lockfile info for the dotfile.
+func (c *Client) captureFile(tx *transaction, check dotfileCheck) (dotfileInfo, error) {
+	data, err := os.ReadFile(check.df.DstPath)
+	if err != nil {
+		return dotfileInfo{}, errors.Wrapf(err, "failed to read %s", check.df.DstPath)
+	}
+	srcPath := filepath.Join(c.layerDir(check.df), filepath.FromSlash(check.df.SrcPath))
+	perm, err := capturePerm(srcPath, check.df.DstPath)
+	if err != nil {
+		return dotfileInfo{}, err
+	}
+	if err := tx.writeFile(srcPath, data, perm); err != nil {
+		return dotfileInfo{}, err
+	}
+	// The captured content is now what was last applied
+	if err := tx.writeFile(c.basePath(check.df.Name), data, 0o644); err != nil {
+		return dotfileInfo{}, err
+	}
+	dfInfo := newDotfileInfo(check.df)
+	dfInfo.DstHash = hashData(defaultHashAlgo, data)
+	return dfInfo, nil
+}
+
+// captureDir copies the files in the destination directory of the dotfile in check to its source
+// directory as part of tx. Only files that are in the source directory or that were previously
+// applied are captured. If one of them was deleted from the destination, it is also deleted from
+// the source. It returns the new lockfile info for the dotfile.
+func (c *Client) captureDir(tx *transaction, check dotfileCheck) (dotfileInfo, error) {
+	df := check.df
+	info, err := os.Lstat(df.DstPath)
+	if err != nil {
+		return dotfileInfo{}, errors.Wrapf(err, "failed to get info of %s", df.DstPath)
+	}
+	if !info.IsDir() {
+		return dotfileInfo{}, errors.Errorf("%s is no longer a directory", df.DstPath)
+	}
+
+	relSet := make(map[string]bool)
+	for rel := range check.info.Files {
+		relSet[rel] = true
+	}
+	for rel := range check.srcFiles {
+		relSet[rel] = true
+	}
+	rels := make([]string, 0, len(relSet))
+	for rel := range relSet {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	srcDir := filepath.Join(c.layerDir(df), filepath.FromSlash(df.SrcPath))
+	dfInfo := newDotfileInfo(df)
+	dfInfo.Files = make(map[string]string)
+	for _, rel := range rels {
+		dstPath := filepath.Join(df.DstPath, filepath.FromSlash(rel))
+		srcPath := filepath.Join(srcDir, filepath.FromSlash(rel))
+		data, err := os.ReadFile(dstPath)
+		if errors.Is(err, os.ErrNotExist) {
+			if err := tx.remove(srcPath); err != nil {
+				return dotfileInfo{}, err
+			}
+			continue
+		}
+		if err != nil {
+			return dotfileInfo{}, errors.Wrapf(err, "failed to read %s", dstPath)
+		}
+		perm, err := capturePerm(srcPath, dstPath)
+		if err != nil {
+			return dotfileInfo{}, err
+		}
+		if err := tx.writeFile(srcPath, data, perm); err != nil {
+			return dotfileInfo{}, err
+		}
+		dfInfo.Files[rel] = hashData(defaultHashAlgo, data)
+	}
+	dfInfo.DstHash = hashFiles(defaultHashAlgo, dfInfo.Files)
+	return dfInfo, nil
+}
+
+// capturePerm returns the permissions to use when capturing the file at dstPath to srcPath.
+// The permissions of the source are kept if it exists, otherwise the ones of the destination are used.
+func capturePerm(srcPath, dstPath string) (fs.FileMode, error) {
+	info, err := os.Stat(srcPath)
+	if errors.Is(err, os.ErrNotExist) {
+		info, err = os.Stat(dstPath)
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to get info of %s", srcPath)
+	}
+	return info.Mode().Perm(), nil
+}
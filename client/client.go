@@ -2,17 +2,19 @@ package client
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	stderrors "errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
+	"time"
 
 	"github.com/cszatmary/dot/dotfile"
+	"github.com/cszatmary/dot/internal/archive"
 	"github.com/pkg/errors"
 )
 
@@ -22,16 +24,6 @@ var ErrNotSetup = stderrors.New("not setup")
 // ErrSetup is returned when dot has already been setup with a different registry.
 var ErrSetup = stderrors.New("already setup with a different registry")
 
-type lockfile struct {
-	RegistryDir string                 `json:"registryDir"`
-	Dotfiles    map[string]dotfileInfo `json:"dotfiles"`
-}
-
-type dotfileInfo struct {
-	// stringified md5 hash, used to determine if the file has been modified
-	DstHash string `json:"dstHash"`
-}
-
 // Debugger wraps the Debugf method and represents any type that
 // can write debug messages.
 type Debugger interface {
@@ -47,15 +39,23 @@ func (noopDebugger) Debugf(format string, args ...interface{}) {}
 type Client struct {
 	lf       *lockfile
 	registry *dotfile.Registry
+	tmplData *templateData
+	plat     *platform
+	// archiveSum is the checksum of the registry archive that was loaded, if the registry is an archive.
+	archiveSum string
 	// configurable
-	homeDir  string
-	debugger Debugger
+	homeDir         string
+	debugger        Debugger
+	backupRetention int
+	lockTimeout     time.Duration
+	hookOutput      io.Writer
 }
 
 // New creates a new Client instance.
 func New(opts ...Option) (*Client, error) {
 	c := &Client{
-		lf: &lockfile{},
+		lf:              &lockfile{},
+		backupRetention: DefaultBackupRetention,
 	}
 	for _, opt := range opts {
 		opt(c)
@@ -64,6 +64,9 @@ func New(opts ...Option) (*Client, error) {
 	if c.debugger == nil {
 		c.debugger = noopDebugger{}
 	}
+	if c.hookOutput == nil {
+		c.hookOutput = io.Discard
+	}
 	if c.homeDir == "" {
 		homeDir, err := os.UserHomeDir()
 		if err != nil {
@@ -72,29 +75,19 @@ func New(opts ...Option) (*Client, error) {
 		c.homeDir = homeDir
 	}
 
-	lfp := c.lockfilePath()
-	f, err := os.Open(lfp)
-	if errors.Is(err, os.ErrNotExist) {
-		// No lockfile, dot has not been setup
-		return c, nil
-	}
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to open lockfile %s", lfp)
-	}
-	defer f.Close()
-
-	err = json.NewDecoder(f).Decode(c.lf)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to parse lockfile %s", lfp)
+	// The lock isn't held, so a migrated lockfile is saved by the next operation that holds it
+	if err := c.readLockfile(false); err != nil {
+		return nil, err
 	}
 	if !c.IsSetup() {
 		return c, nil
 	}
 
 	// dot is setup, load registry
-	c.registry, err = dotfile.NewRegistry(os.DirFS(c.lf.RegistryDir))
+	var err error
+	c.registry, c.archiveSum, err = c.openRegistry(c.lf.RegistryDir, c.lf.Archive != "", c.lf.Layers)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to load dot registry at %s", c.lf.RegistryDir)
+		return nil, err
 	}
 	return c, nil
 }
@@ -116,37 +109,87 @@ func WithDebugger(d Debugger) Option {
 	}
 }
 
+// WithBackupRetention sets the maximum number of backups that are kept for each dotfile.
+// Once the limit is reached, the oldest backups are removed. The backup created when the
+// dotfile was setup is always kept. If n <= 0, all backups are kept.
+// Defaults to DefaultBackupRetention.
+func WithBackupRetention(n int) Option {
+	return func(c *Client) {
+		c.backupRetention = n
+	}
+}
+
+// WithLockTimeout sets how long the client should wait for another dot process to finish
+// before giving up and returning ErrLocked. By default, ErrLocked is returned immediately.
+func WithLockTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.lockTimeout = d
+	}
+}
+
+// WithHookOutput sets where the output of hooks run by Apply is written.
+// By default, the output is discarded.
+func WithHookOutput(w io.Writer) Option {
+	return func(c *Client) {
+		c.hookOutput = w
+	}
+}
+
 // IsSetup returns whether or not dot has been setup to manage dotfiles.
 func (c *Client) IsSetup() bool {
 	return c.lf.RegistryDir != ""
 }
 
-// configPath returns the root dir where dot stores config.
-func (c *Client) configPath() string {
-	return filepath.Join(c.homeDir, ".config", "dot")
+// Profile returns the profile chosen when dot was setup, or an empty string if all dotfiles are used.
+func (c *Client) Profile() string {
+	return c.lf.Profile
 }
 
-func (c *Client) lockfilePath() string {
-	return filepath.Join(c.configPath(), "dot.lock")
+// dotfiles returns the dotfiles with the given names from the registry. If no names are provided,
+// all the dotfiles in the current profile are returned.
+func (c *Client) dotfiles(names ...string) ([]dotfile.Dotfile, error) {
+	var dfs []dotfile.Dotfile
+	var err error
+	if len(names) == 0 && c.lf.Profile != "" {
+		dfs, err = c.registry.ProfileDotfiles(c.lf.Profile)
+	} else {
+		dfs, err = c.registry.Dotfiles(names...)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get dotfiles from registry")
+	}
+	return dfs, nil
 }
 
-func (c *Client) dotfileBackupPath(df dotfile.Dotfile) string {
-	return filepath.Join(c.configPath(), "backups", df.SrcPath) + ".bak"
+// configPath returns the root dir where dot stores config.
+func (c *Client) configPath() string {
+	return filepath.Join(c.homeDir, ".config", "dot")
 }
 
-func (c *Client) writeLockfile() error {
-	lfp := c.lockfilePath()
-	f, err := os.OpenFile(lfp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
-	if err != nil {
-		return errors.Wrapf(err, "failed to create/open file %s", lfp)
-	}
-	defer f.Close()
+// backupsPath returns the dir where backups of dotfiles are stored.
+func (c *Client) backupsPath() string {
+	return filepath.Join(c.configPath(), "backups")
+}
 
-	err = json.NewEncoder(f).Encode(c.lf)
-	if err != nil {
-		return errors.Wrapf(err, "failed to write lockfile to %s", lfp)
-	}
-	return nil
+// SetupOptions configures how Setup sets up dot.
+type SetupOptions struct {
+	// RegistryDir is the path to the registry directory. It may start with '~'.
+	// It may also be the URL of a git repository, ex: https://github.com/me/dotfiles.git,
+	// in which case the repository is cloned into a directory managed by dot.
+	// It may also be the path or URL of a .zip, .tar.gz, or .tgz archive containing the registry.
+	// Archives are read-only, so dotfiles from them cannot be added, forgotten, captured, or installed as symlinks.
+	RegistryDir string
+	// Layers are paths to registry directories that are layered on top of RegistryDir, from lowest to highest.
+	// Dotfiles in a layer override dotfiles with the same name in the layers below it, and new dotfiles
+	// are added to the highest layer. Layers must be local directories and may start with '~'.
+	Layers []string
+	// Force overwrites the registry dir if dot was already setup with a different one,
+	// and sets up dotfiles again even if they were previously setup.
+	Force bool
+	// Profile is the profile from the registry to use. Only the dotfiles in the profile
+	// are setup, and Apply, Status, Diff, and Capture only use them when no names are provided.
+	// If empty, the current profile is kept. If there is no current profile, all dotfiles are used.
+	Profile string
 }
 
 // Setup will setup dot to manage dotfiles. If the dotfile destination already exists,
@@ -154,18 +197,80 @@ func (c *Client) writeLockfile() error {
 // Setup will only setup dotfiles that have not been previously setup. This means
 // it can be called multiple times to setup additional dotfiles.
 //
-// If registryDir is different than the one used by dot, Setup will return ErrSetup
-// unless force is true, in which case it will overwrite the current registry dir.
-func (c *Client) Setup(registryDir string, force bool) error {
-	registryDir = expandTilde(registryDir, c.homeDir)
+// If opts.RegistryDir or opts.Layers are different than the ones used by dot, Setup will return ErrSetup
+// unless opts.Force is true, in which case it will overwrite the current registry dir.
+func (c *Client) Setup(opts SetupOptions) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	registryDir := expandTilde(opts.RegistryDir, c.homeDir)
+	var remote, archiveSrc string
+	switch {
+	case archive.IsArchive(opts.RegistryDir) && isHTTPURL(opts.RegistryDir):
+		archiveSrc = opts.RegistryDir
+		registryDir = c.registryArchivePath(archiveSrc)
+	case archive.IsArchive(opts.RegistryDir):
+		registryDir, err = filepath.Abs(registryDir)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get absolute path of %s", opts.RegistryDir)
+		}
+		archiveSrc = registryDir
+	case isGitURL(opts.RegistryDir):
+		remote = opts.RegistryDir
+		registryDir = c.registryCachePath()
+	}
+	var layers []string
+	for _, l := range opts.Layers {
+		if isGitURL(l) || archive.IsArchive(l) {
+			return errors.Errorf("layer %s must be a local directory", l)
+		}
+		dir, err := filepath.Abs(expandTilde(l, c.homeDir))
+		if err != nil {
+			return errors.Wrapf(err, "failed to get absolute path of %s", l)
+		}
+		layers = append(layers, dir)
+	}
+	force := opts.Force
 	// Check if already setup
-	if c.lf.RegistryDir != "" && c.lf.RegistryDir != registryDir && !force {
+	changed := c.lf.RegistryDir != registryDir || c.lf.Remote != remote || c.lf.Archive != archiveSrc || !stringsEqual(c.lf.Layers, layers)
+	if c.lf.RegistryDir != "" && changed && !force {
+		if remote != "" {
+			return errors.Wrap(ErrSetup, remote)
+		}
+		if archiveSrc != "" {
+			return errors.Wrap(ErrSetup, archiveSrc)
+		}
 		return errors.Wrap(ErrSetup, registryDir)
 	}
-	var err error
-	c.registry, err = dotfile.NewRegistry(os.DirFS(registryDir))
+	if isHTTPURL(archiveSrc) {
+		// Always download the archive so that setting up again gets the latest version
+		c.debugger.Debugf("Downloading registry archive from %s", archiveSrc)
+		if err := c.downloadArchive(archiveSrc, registryDir, layers); err != nil {
+			return err
+		}
+	}
+	if remote != "" {
+		// Only clone if needed so that setting up again doesn't lose any local changes to the registry
+		_, err := os.Stat(registryDir)
+		if c.lf.Remote != remote || errors.Is(err, os.ErrNotExist) {
+			if err := c.cloneRegistry(remote, layers); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to get info of %s", registryDir)
+		}
+	}
+	c.tmplData = nil
+	c.registry, c.archiveSum, err = c.openRegistry(registryDir, archiveSrc != "", layers)
 	if err != nil {
-		return errors.Wrapf(err, "failed to load dot registry at %s", registryDir)
+		return err
+	}
+	profile := opts.Profile
+	if profile == "" {
+		profile = c.lf.Profile
 	}
 
 	// Get hash of each dst dotfile
@@ -176,12 +281,20 @@ func (c *Client) Setup(registryDir string, force bool) error {
 	}
 
 	dfs, err := c.registry.Dotfiles()
+	if profile != "" {
+		dfs, err = c.registry.ProfileDotfiles(profile)
+	}
 	if err != nil {
 		return errors.Wrap(err, "failed to get dotfiles from registry")
 	}
 
 	for _, df := range dfs {
-		if !supportsOS(df) {
+		reason, err := c.checkPlatform(df)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			c.debugger.Debugf("Skipping %s: %s", df.Name, reason)
 			continue
 		}
 		// Check if already setup, and ignore if so unless in force mode
@@ -191,198 +304,574 @@ func (c *Client) Setup(registryDir string, force bool) error {
 		}
 
 		df.DstPath = expandTilde(df.DstPath, c.homeDir)
-		f, err := os.Open(df.DstPath)
-		if errors.Is(err, os.ErrNotExist) {
-			// It's fine if dst doesn't exist, it will be created by Apply
-			c.lf.Dotfiles[df.Name] = dotfileInfo{}
+		c.debugger.Debugf("Saving hash of %s", df.DstPath)
+		if df.IsDir && !df.IsSymlink() {
+			if err := c.setupDir(df); err != nil {
+				return err
+			}
 			continue
 		}
+		hash, exists, err := hashDst(defaultHashAlgo, df.DstPath)
 		if err != nil {
-			return errors.Wrapf(err, "failed to open file %s", df.DstPath)
+			return err
 		}
-
-		c.debugger.Debugf("Saving hash of %s", df.DstPath)
-		hash, err := md5Hash(f)
-		if err != nil {
-			return errors.Wrapf(err, "failed to get hash of %s", df.DstPath)
+		if !exists {
+			// It's fine if dst doesn't exist, it will be created by Apply
+			c.lf.Dotfiles[df.Name] = newDotfileInfo(df)
+			continue
 		}
 
 		// Backup dotfile, do this before saving the hash and marking this as "setup"
-		c.debugger.Debugf("Creating backup of %s", df.DstPath)
-		backupPath := c.dotfileBackupPath(df)
-		if err := copyFile(df.DstPath, backupPath); err != nil {
-			return errors.Wrapf(err, "failed to backup %s to %s", df.DstPath, backupPath)
+		if _, err := c.backupDotfile(df, BackupReasonSetup, nil); err != nil {
+			return err
+		}
+		if !df.IsSymlink() {
+			if err := c.saveSetupBase(df); err != nil {
+				return err
+			}
 		}
 
-		c.lf.Dotfiles[df.Name] = dotfileInfo{DstHash: string(hash)}
+		dfInfo := newDotfileInfo(df)
+		dfInfo.DstHash = hash
+		c.lf.Dotfiles[df.Name] = dfInfo
 	}
 	c.debugger.Debugf("Finished backing up dotfiles and saving hashes")
 
 	// Mark as setup
+	if c.lf.Remote != remote {
+		c.lf.Commit = ""
+	}
+	// The checksum is only recorded by Apply, since none of the dotfiles have been applied from the archive yet
+	if c.lf.Archive != archiveSrc {
+		c.lf.ArchiveSum = ""
+	}
 	c.lf.RegistryDir = registryDir
+	c.lf.Profile = profile
+	c.lf.Remote = remote
+	c.lf.Archive = archiveSrc
+	c.lf.Layers = layers
 	if err := c.writeLockfile(); err != nil {
 		return errors.Wrap(err, "failed to save lockfile")
 	}
 	return nil
 }
 
+// setupDir sets up a dotfile whose source is a directory that is installed by copying.
+// Any files in the destination directory that are also in the source directory are backed up.
+func (c *Client) setupDir(df dotfile.Dotfile) error {
+	info, err := os.Lstat(df.DstPath)
+	if errors.Is(err, os.ErrNotExist) {
+		// It's fine if dst doesn't exist, it will be created by Apply
+		c.lf.Dotfiles[df.Name] = newDotfileInfo(df)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to get info of %s", df.DstPath)
+	}
+
+	if !info.IsDir() {
+		// Back it up so it can be restored, it will be treated as modified when applying
+		if _, err := c.backupDotfile(df, BackupReasonSetup, nil); err != nil {
+			return err
+		}
+		c.lf.Dotfiles[df.Name] = newDotfileInfo(df)
+		return nil
+	}
+	rels, err := c.registry.DotfileFiles(df.Name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get files of dotfile %s", df.Name)
+	}
+	files, err := c.backupDotfile(df, BackupReasonSetup, rels)
+	if err != nil {
+		return err
+	}
+	dfInfo := newDotfileInfo(df)
+	dfInfo.DstHash = hashFiles(defaultHashAlgo, files)
+	dfInfo.Files = files
+	c.lf.Dotfiles[df.Name] = dfInfo
+	return nil
+}
+
 // Apply will copy dotfile sources from a registry to their destination.
 // Optionally, a list of dotfile names can be provided to only apply specific dotfiles.
 // If no names are provided, all dotfiles will be applied.
 //
 // By default, Apply will check if the dotfile destination file has been manually modified.
 // If a modification is detected, the dotfile will not be applied and an error will be
-// returned. If force is set to true, this check is skipped and the dotfile is always applied.
-func (c *Client) Apply(force bool, names ...string) error {
-	retrieved, err := c.registry.Dotfiles(names...)
+// returned. If opts.Force is true, this check is skipped and the dotfile is always applied.
+// If opts.Merge is true, the modifications are merged with the changes to the source instead.
+// If the merge has conflicts, ErrMergeConflict is returned and nothing is applied.
+// A backup is created of any modified dotfile before it is overwritten or merged.
+// If opts.Prune is true, dotfiles that were removed from the registry are also removed.
+//
+// If the registry is from a git remote and no names are provided, the commit of the registry
+// is recorded in the lockfile as the applied commit. Likewise, if the registry is an archive,
+// its checksum is recorded.
+//
+// Hooks are only run if dotfiles are changed. The pre_apply hooks of the registry are run first,
+// followed by the pre_apply hooks of each dotfile before it is written. Once all dotfiles are written,
+// the post_apply hooks of each dotfile are run, followed by the post_apply hooks of the registry.
+// If a hook fails, Apply stops and rolls back all changes, unless opts.IgnoreHookErrors is true.
+//
+// Apply is atomic. If any dotfile fails to be applied, all changes that were made are
+// rolled back and the lockfile is left untouched.
+//
+// Setup and Apply, along with any other method that modifies dotfiles, lock the dot config
+// so that only one dot process can modify dotfiles at a time. If another process holds the
+// lock, ErrLocked is returned after waiting for the duration set by WithLockTimeout.
+func (c *Client) Apply(opts ApplyOptions, names ...string) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	unlock, err := c.lock()
 	if err != nil {
-		return errors.Wrap(err, "failed to get dotfiles from registry")
+		return err
 	}
-	// Filter out dotfiles not supported by the current OS
-	var dfs []dotfile.Dotfile
-	for _, df := range retrieved {
-		if supportsOS(df) {
-			dfs = append(dfs, df)
-		}
+	defer unlock()
+
+	c.debugger.Debugf("Checking if dotfiles have been modified or are outdated")
+	planned, err := c.plan(opts, names...)
+	if err != nil {
+		return err
 	}
 
 	// Make sure it is safe to apply updates
 	// If there are any dotfiles whose hash is not equal to the hash
 	// in the lockfile then it has been manually modified
-	c.debugger.Debugf("Checking if dotfiles have been modified")
-	for _, df := range dfs {
-		dfInfo, ok := c.lf.Dotfiles[df.Name]
-		// Make sure dotfile was setup
-		if !ok {
-			return errors.Wrap(ErrNotSetup, df.Name)
+	var outdated []plannedAction
+	var pruned []orphanCheck
+	for _, pa := range planned {
+		switch pa.Type {
+		case ActionBlocked:
+			switch {
+			case !pa.check.setup:
+				return errors.Wrap(ErrNotSetup, pa.Name)
+			case pa.conflicts > 0:
+				return errors.Wrapf(ErrMergeConflict, "%s has %d conflicts", pa.DstPath, pa.conflicts)
+			case opts.Merge:
+				return errors.Errorf("%s was manually modified and cannot be merged: %s", pa.DstPath, pa.Reason)
+			}
+			return errors.Errorf("%s was manually modified", pa.DstPath)
+		case ActionCreate, ActionOverwrite, ActionMerge:
+			c.debugger.Debugf("%s will be updated: %s", pa.Name, pa.Reason)
+			outdated = append(outdated, pa)
+		case ActionPrune:
+			c.debugger.Debugf("%s will be pruned: %s", pa.Name, pa.Reason)
+			pruned = append(pruned, pa.orphan)
+		default:
+			c.debugger.Debugf("Skipping %s: %s", pa.Name, pa.Reason)
 		}
+	}
 
-		df.DstPath = expandTilde(df.DstPath, c.homeDir)
-		f, err := os.Open(df.DstPath)
-		if errors.Is(err, os.ErrNotExist) {
-			// Dst doesn't exist, will be created below
-			continue
-		}
+	// Stage all the changes before writing anything so that any errors
+	// reading sources are caught before the filesystem is modified
+	var staged []stagedDotfile
+	for _, o := range outdated {
+		s, err := c.stageDotfile(o.check)
 		if err != nil {
-			return errors.Wrapf(err, "failed to open file %s", df.DstPath)
+			return errors.Wrapf(err, "failed to apply changes to %s", o.Name)
 		}
-
-		hash, err := md5Hash(f)
-		if err != nil {
-			return errors.Wrapf(err, "failed to get hash of %s", df.DstPath)
+		if o.Type == ActionMerge {
+			s.data = o.merged
 		}
-		if string(hash) == dfInfo.DstHash {
-			c.debugger.Debugf("No modifications detected to %s", df.DstPath)
+		s.action = o.Type
+		staged = append(staged, s)
+	}
+
+	// Don't lose manual modifications that are being overwritten
+	var backedUp []string
+	idx, err := c.readBackupIndex()
+	if err != nil {
+		return err
+	}
+	for _, o := range outdated {
+		if !o.check.modified || !o.check.dstExists {
 			continue
 		}
-		if !force {
-			return errors.Errorf("%s was manually modified", df.DstPath)
+		reason := BackupReasonForceApply
+		if o.Type == ActionMerge {
+			reason = BackupReasonMerge
 		}
-		c.debugger.Debugf("%s was manually modified, but force mode is enabled", df.DstPath)
+		if err := c.backupCurrent(idx, o.check.df, reason); err != nil {
+			return errors.Wrapf(err, "failed to backup %s", o.Name)
+		}
+		backedUp = append(backedUp, o.Name)
 	}
-
-	// Check if lockfiles are out of date
-	type outdatedLockfile struct {
-		df      dotfile.Dotfile
-		newHash string
+	if len(backedUp) > 0 {
+		if err := c.saveBackupIndex(idx, backedUp...); err != nil {
+			return err
+		}
 	}
-	var outdated []outdatedLockfile
-	c.debugger.Debugf("Checking if dotfiles are outdated")
-	for _, df := range dfs {
-		f, err := c.registry.OpenDotfile(df.Name)
+
+	var commit string
+	if c.lf.Remote != "" && len(names) == 0 {
+		commit, err = c.headCommit()
 		if err != nil {
-			return errors.Wrapf(err, "failed to open dotfile %s", df.Name)
+			return err
 		}
-		hash, err := md5Hash(f)
-		if err != nil {
-			return errors.Wrapf(err, "failed to get hash of %s", df.DstPath)
+	}
+
+	// Apply src to dest. This is done as a transaction, if anything fails all
+	// changes are rolled back so dotfiles are never left partially applied.
+	// The lockfile is only updated once all dotfiles have been written.
+	tx := newTransaction(c.debugger)
+	var changed []string
+	for _, s := range staged {
+		changed = append(changed, s.check.df.Name)
+	}
+	for _, o := range pruned {
+		changed = append(changed, o.name)
+	}
+	if len(changed) > 0 {
+		if err := c.runRegistryHooks(hookPreApply, changed, opts.IgnoreHookErrors); err != nil {
+			return err
 		}
-		dfInfo := c.lf.Dotfiles[df.Name]
-		strHash := string(hash)
-		if force || strHash != dfInfo.DstHash {
-			c.debugger.Debugf("%s is out of date, updating", df.Name)
-			outdated = append(outdated, outdatedLockfile{df, strHash})
+	}
+	// Run all the pre hooks before anything is written so they see the dotfiles as they were
+	for _, s := range staged {
+		if err := c.runDotfileHooks(s, hookPreApply, opts.IgnoreHookErrors); err != nil {
+			return err
 		}
 	}
-
-	// Apply src to dest
-	// TODO would be nice if this behaved like an automic transaction
-	// i.e. if one failed any successful ones would be rolled back
-	// and the user could retry rather than leaving in a partially successful state
-	// for now the user will just need to manually retry the ones that failed though
-	for _, o := range outdated {
-		c.debugger.Debugf("Applying changes to dotfile %s", o.df.Name)
-		if err := c.copyDotfile(o.df); err != nil {
-			return errors.Wrapf(err, "failed to apply changes to %s", o.df.Name)
+	dfInfos := make(map[string]dotfileInfo)
+	for _, s := range staged {
+		c.debugger.Debugf("Applying changes to dotfile %s", s.check.df.Name)
+		if err := s.write(tx); err != nil {
+			err = errors.Wrapf(err, "failed to apply changes to %s", s.check.df.Name)
+			return c.rollback(tx, err)
+		}
+		dfInfos[s.check.df.Name] = s.info()
+	}
+	for _, o := range pruned {
+		c.debugger.Debugf("Pruning dotfile %s", o.name)
+		if err := c.pruneOrphan(tx, o); err != nil {
+			return c.rollback(tx, errors.Wrapf(err, "failed to prune %s", o.name))
+		}
+	}
+	for _, s := range staged {
+		if err := c.runDotfileHooks(s, hookPostApply, opts.IgnoreHookErrors); err != nil {
+			return c.rollback(tx, err)
+		}
+	}
+	if len(changed) > 0 {
+		if err := c.runRegistryHooks(hookPostApply, changed, opts.IgnoreHookErrors); err != nil {
+			return c.rollback(tx, err)
 		}
-		c.lf.Dotfiles[o.df.Name] = dotfileInfo{o.newHash}
 	}
 	c.debugger.Debugf("Finished applying changes to dotfiles")
+
+	prevInfos := make(map[string]dotfileInfo)
+	for name, info := range dfInfos {
+		prevInfos[name] = c.lf.Dotfiles[name]
+		c.lf.Dotfiles[name] = info
+	}
+	for _, o := range pruned {
+		prevInfos[o.name] = o.info
+		delete(c.lf.Dotfiles, o.name)
+	}
+	prevCommit, prevArchiveSum := c.lf.Commit, c.lf.ArchiveSum
+	if commit != "" {
+		c.lf.Commit = commit
+	}
+	if c.lf.Archive != "" && len(names) == 0 {
+		c.lf.ArchiveSum = c.archiveSum
+	}
 	if err := c.writeLockfile(); err != nil {
-		return errors.Wrap(err, "failed to save lockfile")
+		for name, info := range prevInfos {
+			c.lf.Dotfiles[name] = info
+		}
+		c.lf.Commit, c.lf.ArchiveSum = prevCommit, prevArchiveSum
+		return c.rollback(tx, errors.Wrap(err, "failed to save lockfile"))
 	}
 	return nil
 }
 
-func (c *Client) copyDotfile(df dotfile.Dotfile) error {
+// stagedDotfile contains everything needed to write a dotfile to its destination.
+type stagedDotfile struct {
+	check dotfileCheck
+	// action is the action that was planned for the dotfile.
+	action ActionType
+	data   []byte
+	perm   fs.FileMode
+	// base is the source content of a dotfile that is installed by copying a file. It is saved
+	// as the merge base, and is different than data if the source was merged with the destination.
+	base     []byte
+	basePath string
+	// linkTarget is the path the destination should link to if the dotfile is installed as a symlink.
+	linkTarget string
+	// files contains the files to write if the dotfile is a directory.
+	files []sourceFile
+	// prune contains the paths of files, relative to the destination directory, that should be removed from it.
+	prune []string
+}
+
+// stageDotfile prepares the dotfile from check to be written.
+func (c *Client) stageDotfile(check dotfileCheck) (stagedDotfile, error) {
+	s := stagedDotfile{check: check}
+	var err error
+	switch {
+	case check.df.IsSymlink():
+		s.linkTarget, err = c.symlinkTarget(check.df)
+	case check.df.IsDir:
+		s, err = c.stageDir(s)
+	default:
+		s.data, s.perm, err = c.readSource(check.df)
+		if check.attrs.perm != 0 {
+			s.perm = check.attrs.perm
+		}
+		s.base = s.data
+		s.basePath = c.basePath(check.df.Name)
+	}
+	return s, err
+}
+
+// info returns the lockfile info of the staged dotfile once it has been written.
+// The hashes always use defaultHashAlgo, regardless of the algorithm used by the check.
+func (s stagedDotfile) info() dotfileInfo {
+	df := s.check.df
+	info := newDotfileInfo(df)
+	switch {
+	case s.check.df.IsSymlink():
+		info.DstHash = hashSymlink(defaultHashAlgo, s.linkTarget)
+	case s.check.df.IsDir:
+		info.Files = make(map[string]string, len(s.files))
+		for _, f := range s.files {
+			info.Files[f.rel] = hashData(defaultHashAlgo, f.data)
+		}
+		info.DstHash = hashFiles(defaultHashAlgo, info.Files)
+	default:
+		// If the source was merged, the destination has local modifications so it
+		// should still be considered modified, therefore use the hash of the source
+		info.DstHash = hashData(defaultHashAlgo, s.base)
+	}
+	return info
+}
+
+// write writes the staged dotfile to its destination as part of tx.
+func (s stagedDotfile) write(tx *transaction) error {
+	if s.check.df.IsSymlink() {
+		return tx.symlink(s.linkTarget, s.check.df.DstPath)
+	}
+	if s.check.df.IsDir {
+		return s.writeDir(tx)
+	}
+	if err := tx.writeFile(s.check.df.DstPath, s.data, s.perm); err != nil {
+		return err
+	}
+	if err := s.check.attrs.setOwner(tx, s.check.df.DstPath); err != nil {
+		return err
+	}
+	return tx.writeFile(s.basePath, s.base, 0o644)
+}
+
+// rollback rolls back tx after err occurred. It returns err, annotated with
+// any error that occurred while rolling back.
+func (c *Client) rollback(tx *transaction, err error) error {
+	c.debugger.Debugf("Error occurred, rolling back changes: %v", err)
+	if rbErr := tx.rollback(); rbErr != nil {
+		return errors.Wrapf(err, "%v, changes may have been partially applied", rbErr)
+	}
+	return err
+}
+
+// dotfileCheck contains the result of comparing a dotfile's source and destination
+// against the information recorded in the lockfile.
+type dotfileCheck struct {
+	// df is the dotfile with DstPath expanded.
+	df dotfile.Dotfile
+	// setup is whether or not the dotfile has been setup to be managed by dot.
+	setup bool
+	// dstExists is whether or not the dotfile destination exists.
+	dstExists bool
+	// modified is whether or not the destination was changed since dot last wrote it.
+	modified bool
+	// outdated is whether or not the source differs from what dot last wrote.
+	outdated bool
+	// dstIsSymlink is whether or not the destination is a symlink.
+	dstIsSymlink bool
+	// srcHash is the hash of the dotfile source using the algorithm from info. If the
+	// dotfile is installed as a symlink, it is the hash of the symlink target path.
+	srcHash string
+	// srcFiles contains the hash of each source file if the dotfile is a directory.
+	srcFiles map[string]string
+	// info is the information about the dotfile stored in the lockfile.
+	info dotfileInfo
+	// attrs is the permissions and ownership the destination should have.
+	attrs dstAttrs
+	// drift describes how the permissions or ownership of the destination differ from attrs.
+	// It is empty if they match or the destination does not exist.
+	drift string
+	// attrsChanged is whether or not the permissions or ownership of the dotfile
+	// changed in the registry since it was last applied.
+	attrsChanged bool
+}
+
+// checkDotfile determines the state of df by hashing its source and destination
+// and comparing them with the hash stored in the lockfile.
+// If df has not been setup, only the setup and df fields will be populated.
+func (c *Client) checkDotfile(df dotfile.Dotfile) (dotfileCheck, error) {
 	df.DstPath = expandTilde(df.DstPath, c.homeDir)
-	dir := filepath.Dir(df.DstPath)
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return fmt.Errorf("failed to create directory %q: %w", dir, err)
+	check := dotfileCheck{df: df}
+	dfInfo, ok := c.lf.Dotfiles[df.Name]
+	if !ok {
+		return check, nil
+	}
+	if dfInfo.DstPath == "" {
+		// Older versions of dot did not record the destination
+		dfInfo.DstPath = df.DstPath
+		c.lf.Dotfiles[df.Name] = dfInfo
+	}
+	check.setup = true
+	check.info = dfInfo
+	if df.IsDir && !df.IsSymlink() {
+		check, err := c.checkDir(check)
+		if err != nil {
+			return check, err
+		}
+		return checkAttrs(check)
 	}
 
-	srcFile, err := c.registry.OpenDotfile(df.Name)
+	dstHash, exists, err := hashDst(dfInfo.algo(), df.DstPath)
 	if err != nil {
-		return fmt.Errorf("failed to open source dotfile %q: %w", df.SrcPath, err)
+		return check, err
+	}
+	if exists {
+		check.dstExists = true
+		check.modified = dstHash != dfInfo.DstHash
+		check.dstIsSymlink, err = isSymlink(df.DstPath)
+		if err != nil {
+			return check, err
+		}
+	}
+	if exists && !check.modified && dfInfo.algo() != defaultHashAlgo {
+		// The destination is what dot last wrote, so it can be rehashed to migrate the hash
+		c.debugger.Debugf("Migrating hash of %s from %s to %s", df.Name, dfInfo.algo(), defaultHashAlgo)
+		dfInfo.DstHash, _, err = hashDst(defaultHashAlgo, df.DstPath)
+		if err != nil {
+			return check, err
+		}
+		dfInfo.HashAlgo = defaultHashAlgo
+		c.lf.Dotfiles[df.Name] = dfInfo
+		check.info = dfInfo
+	}
+
+	if df.IsSymlink() {
+		// The source can't be out of date since the destination points to it,
+		// the only way a symlink changes is if the target path changes
+		target, err := c.symlinkTarget(df)
+		if err != nil {
+			return check, err
+		}
+		check.srcHash = hashSymlink(dfInfo.algo(), target)
+	} else {
+		// Hash the rendered source so that changes to template variables are detected
+		src, _, err := c.readSource(df)
+		if err != nil {
+			return check, errors.Wrapf(err, "failed to read dotfile %s", df.Name)
+		}
+		check.srcHash = hashData(dfInfo.algo(), src)
 	}
-	defer srcFile.Close()
+	check.outdated = check.srcHash != dfInfo.DstHash
+	return checkAttrs(check)
+}
 
-	stat, err := srcFile.Stat()
+// symlinkTarget returns the absolute path to the source of df that its destination should link to.
+func (c *Client) symlinkTarget(df dotfile.Dotfile) (string, error) {
+	dir := c.layerDir(df)
+	if c.isArchiveLayer(dir) {
+		return "", errors.Errorf("%s cannot be installed as a symlink since the registry is an archive", df.Name)
+	}
+	target, err := filepath.Abs(filepath.Join(dir, df.SrcPath))
 	if err != nil {
-		return fmt.Errorf("failed to stat %s", df.SrcPath)
+		return "", errors.Wrapf(err, "failed to get absolute path of %s", df.SrcPath)
 	}
-	dstFile, err := os.OpenFile(df.DstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, stat.Mode())
+	return target, nil
+}
+
+// readSource reads the contents of the source of df from the registry.
+// If df is a template, it is rendered and the rendered contents are returned.
+// The permissions of the source file are also returned.
+func (c *Client) readSource(df dotfile.Dotfile) ([]byte, fs.FileMode, error) {
+	f, err := c.registry.OpenDotfile(df.Name)
 	if err != nil {
-		return fmt.Errorf("failed to open/create file %q: %w", df.DstPath, err)
+		return nil, 0, fmt.Errorf("failed to open source dotfile %q: %w", df.SrcPath, err)
 	}
-	defer dstFile.Close()
+	return c.readSourceFile(df, df.SrcPath, f)
+}
 
-	if _, err = io.Copy(dstFile, srcFile); err != nil {
-		return fmt.Errorf("failed to copy %q to %q: %w", df.SrcPath, df.DstPath, err)
+// readSourceFile reads the contents of f which is the source file at srcPath belonging to df.
+// If df is a template, the contents are rendered. readSourceFile closes f when it is finished.
+func (c *Client) readSourceFile(df dotfile.Dotfile, srcPath string, f fs.File) ([]byte, fs.FileMode, error) {
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to stat %s", srcPath)
 	}
-	return nil
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read source dotfile %q: %w", srcPath, err)
+	}
+	if df.Template {
+		data, err = c.renderTemplate(srcPath, data)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return data, stat.Mode().Perm(), nil
 }
 
 // Utils
 
-// supportsOS checks whether the dotfile supports the current OS.
-func supportsOS(df dotfile.Dotfile) bool {
-	// No OSes defined means all are supported
-	if len(df.OS) == 0 {
-		return true
+// hashData returns the hash of data using algo.
+func hashData(algo hashAlgo, data []byte) string {
+	if algo == hashMD5 {
+		hash := md5.Sum(data)
+		return hex.EncodeToString(hash[:])
 	}
-	currentOS := runtime.GOOS
-	for _, os := range df.OS {
-		if os == currentOS {
-			return true
-		}
-		// macOS is supported as an alias for darwin
-		if os == "macOS" && currentOS == "darwin" {
-			return true
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// hashSymlink returns the hash of a symlink that points to target.
+// This is used in place of a content hash for symlinks.
+func hashSymlink(algo hashAlgo, target string) string {
+	return hashData(algo, []byte("symlink:"+target))
+}
+
+// hashDst returns the hash of the dotfile destination at path and whether or not it exists.
+// If path is a symlink, the hash of the symlink is returned instead of the hash of the file it points to.
+func hashDst(algo hashAlgo, path string) (string, bool, error) {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, errors.Wrapf(err, "failed to get info of %s", path)
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", false, errors.Wrapf(err, "failed to read symlink %s", path)
 		}
+		return hashSymlink(algo, target), true, nil
+	}
+	if info.IsDir() {
+		return "", false, errors.Errorf("%s is a directory", path)
 	}
-	return false
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, errors.Wrapf(err, "failed to get hash of %s", path)
+	}
+	return hashData(algo, data), true, nil
 }
 
-// md5Hash returns the md5 hash of the data read from rc.
-// md5Hash will close rc when it is finished.
-func md5Hash(rc io.ReadCloser) (string, error) {
-	defer rc.Close()
-	hash := md5.New()
-	if _, err := io.Copy(hash, rc); err != nil {
-		return "", err
+// isSymlink returns whether or not the file at path is a symlink.
+func isSymlink(path string) (bool, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get info of %s", path)
 	}
-	return hex.EncodeToString(hash.Sum(nil)), nil
+	return info.Mode()&fs.ModeSymlink != 0, nil
 }
 
 // expandTilde replaces a ~ at the start of a path with the given homeDir.
@@ -394,6 +883,34 @@ func expandTilde(p, homeDir string) string {
 	return p
 }
 
+// backupFile creates a backup of the file at src at dst. If src is a symlink, the backup
+// will be a symlink with the same target. Otherwise src must be a regular file.
+func backupFile(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return fmt.Errorf("failed to get info of %q: %w", src, err)
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return copyFile(src, dst)
+	}
+
+	target, err := os.Readlink(src)
+	if err != nil {
+		return fmt.Errorf("failed to read symlink %q: %w", src, err)
+	}
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", dir, err)
+	}
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove existing backup %q: %w", dst, err)
+	}
+	if err := os.Symlink(target, dst); err != nil {
+		return fmt.Errorf("failed to create symlink %q: %w", dst, err)
+	}
+	return nil
+}
+
 // copyFile copies the regular file located at src to dst. Any intermediate directories in dst
 // that do not exists will be created. If src is not a regular file an error will be returned.
 func copyFile(src, dst string) error {
@@ -1,12 +1,28 @@
 package client_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/cszatmary/dot/client"
+	"github.com/cszatmary/dot/dotfile"
 )
 
 func TestSetupAndApply(t *testing.T) {
@@ -39,7 +55,7 @@ func TestSetupAndApply(t *testing.T) {
 		t.Error("want dot to not be setup, but it is")
 	}
 
-	err = dotClient.Setup("testdata/registry-1", false)
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "testdata/registry-1"})
 	if err != nil {
 		t.Fatalf("want nil error, got %v", err)
 	}
@@ -47,7 +63,7 @@ func TestSetupAndApply(t *testing.T) {
 		t.Error("want dot to be setup, but it isn't")
 	}
 
-	err = dotClient.Apply(false)
+	err = dotClient.Apply(client.ApplyOptions{})
 	if err != nil {
 		t.Fatalf("want nil error, got %v", err)
 	}
@@ -55,6 +71,2075 @@ func TestSetupAndApply(t *testing.T) {
 	filesEqual(t, filepath.Join(homeDir, ".zshrc"), "testdata/registry-1/zsh/zshrc")
 }
 
+func TestSetupProfile(t *testing.T) {
+	homeDir := t.TempDir()
+	registryDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", registryDir)
+	cfg := `profiles:
+  server: [shell]
+dotfiles:
+  git:
+    src: git/gitconfig
+    dst: ~/.gitconfig
+    tags: [work]
+  zsh:
+    src: zsh/zshrc
+    dst: ~/.zshrc
+    tags: [shell]
+`
+	err := os.WriteFile(filepath.Join(registryDir, "dot.yml"), []byte(cfg), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir, Profile: "personal"})
+	if !errors.Is(err, dotfile.ErrProfileNotFound) {
+		t.Errorf("got %v, want dotfile.ErrProfileNotFound", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir, Profile: "server"})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	// The profile should be used by a new client
+	dotClient, err = client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if got := dotClient.Profile(); got != "server" {
+		t.Errorf("got profile %q, want %q", got, "server")
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	filesEqual(t, filepath.Join(homeDir, ".zshrc"), "testdata/registry-1/zsh/zshrc")
+	if _, err := os.Stat(filepath.Join(homeDir, ".gitconfig")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want %s to not exist, got %v", filepath.Join(homeDir, ".gitconfig"), err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateClean},
+	})
+
+	// Dotfiles outside the profile can still be used explicitly
+	err = dotClient.Apply(client.ApplyOptions{}, "git")
+	if !errors.Is(err, client.ErrNotSetup) {
+		t.Errorf("got %v, want client.ErrNotSetup", err)
+	}
+}
+
+func TestSetupGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	homeDir := t.TempDir()
+	workDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", workDir)
+	runGit(t, workDir, "init", "--quiet")
+	runGit(t, workDir, "add", "-A")
+	runGit(t, workDir, "commit", "--quiet", "-m", "Initial commit")
+	remoteDir := filepath.Join(t.TempDir(), "registry.git")
+	runGit(t, workDir, "clone", "--quiet", "--bare", workDir, remoteDir)
+	remote := "file://" + filepath.ToSlash(remoteDir)
+
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: remote})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	filesEqual(t, filepath.Join(homeDir, ".zshrc"), "testdata/registry-1/zsh/zshrc")
+	lockfileRemoteEqual := func(wantCommit string) {
+		t.Helper()
+		lfData, err := os.ReadFile(filepath.Join(homeDir, ".config", "dot", "dot.lock"))
+		if err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+		var lf struct {
+			RegistryDir string `json:"registryDir"`
+			Remote      string `json:"remote"`
+			Commit      string `json:"commit"`
+		}
+		if err := json.Unmarshal(lfData, &lf); err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+		if want := filepath.Join(homeDir, ".config", "dot", "registry"); lf.RegistryDir != want {
+			t.Errorf("got registry dir %s, want %s", lf.RegistryDir, want)
+		}
+		if lf.Remote != remote {
+			t.Errorf("got remote %s, want %s", lf.Remote, remote)
+		}
+		if lf.Commit != wantCommit {
+			t.Errorf("got commit %s, want %s", lf.Commit, wantCommit)
+		}
+	}
+	lockfileRemoteEqual(runGit(t, workDir, "rev-parse", "HEAD"))
+
+	updated, err := dotClient.Pull()
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if updated {
+		t.Error("want registry to already be up to date")
+	}
+
+	// Push a change to the remote, pulling should fast-forward to it
+	err = os.WriteFile(filepath.Join(workDir, "zsh", "zshrc"), []byte("export EDITOR=vim\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	runGit(t, workDir, "commit", "--quiet", "-am", "Update zshrc")
+	runGit(t, workDir, "push", "--quiet", remoteDir, "HEAD")
+	updated, err = dotClient.Pull()
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if !updated {
+		t.Error("want registry to be updated")
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateClean},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateOutdated},
+	})
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, filepath.Join(homeDir, ".zshrc"), "export EDITOR=vim\n")
+	lockfileRemoteEqual(runGit(t, workDir, "rev-parse", "HEAD"))
+
+	// Setting up with a local registry requires force
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "testdata/registry-1"})
+	if !errors.Is(err, client.ErrSetup) {
+		t.Errorf("got error %v, want %v", err, client.ErrSetup)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "testdata/registry-1", Force: true})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if _, err := dotClient.Pull(); !errors.Is(err, client.ErrNoRemote) {
+		t.Errorf("got error %v, want %v", err, client.ErrNoRemote)
+	}
+}
+
+func TestPullInvalidRegistry(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	homeDir := t.TempDir()
+	workDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", workDir)
+	runGit(t, workDir, "init", "--quiet")
+	runGit(t, workDir, "add", "-A")
+	runGit(t, workDir, "commit", "--quiet", "-m", "Initial commit")
+	remoteDir := filepath.Join(t.TempDir(), "registry.git")
+	runGit(t, workDir, "clone", "--quiet", "--bare", workDir, remoteDir)
+
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "file://" + filepath.ToSlash(remoteDir)})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	// Make an uncommitted change to the registry, like capture would
+	registryDir := filepath.Join(homeDir, ".config", "dot", "registry")
+	zshrc := "export EDITOR=nvim\n"
+	err = os.WriteFile(filepath.Join(registryDir, "zsh", "zshrc"), []byte(zshrc), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	before := runGit(t, registryDir, "rev-parse", "HEAD")
+
+	// Push a change that makes the registry invalid, pulling should fail and go back
+	// to the previous commit without losing the uncommitted change
+	err = os.WriteFile(filepath.Join(workDir, "dot.yml"), []byte("dotfiles:\n  vim:\n    src: vim/vimrc\n    dst: ~/.vimrc\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	runGit(t, workDir, "commit", "--quiet", "-am", "Add vim")
+	runGit(t, workDir, "push", "--quiet", remoteDir, "HEAD")
+	if _, err := dotClient.Pull(); err == nil {
+		t.Error("want non-nil error, got nil")
+	}
+	if got := runGit(t, registryDir, "rev-parse", "HEAD"); got != before {
+		t.Errorf("got registry commit %s, want %s", got, before)
+	}
+	fileContentsEqual(t, filepath.Join(registryDir, "zsh", "zshrc"), zshrc)
+}
+
+func TestSetupGitInvalidRegistry(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	homeDir := t.TempDir()
+	workDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", workDir)
+	runGit(t, workDir, "init", "--quiet")
+	runGit(t, workDir, "add", "-A")
+	runGit(t, workDir, "commit", "--quiet", "-m", "Initial commit")
+	remoteDir := filepath.Join(t.TempDir(), "registry.git")
+	runGit(t, workDir, "clone", "--quiet", "--bare", workDir, remoteDir)
+
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "file://" + filepath.ToSlash(remoteDir)})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	registryDir := filepath.Join(homeDir, ".config", "dot", "registry")
+	before := runGit(t, registryDir, "rev-parse", "HEAD")
+
+	// Setting up with a registry that is invalid should fail and leave the current registry in place
+	err = os.WriteFile(filepath.Join(workDir, "dot.yml"), []byte("dotfiles:\n  vim:\n    src: vim/vimrc\n    dst: ~/.vimrc\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	runGit(t, workDir, "commit", "--quiet", "-am", "Add vim")
+	invalidDir := filepath.Join(t.TempDir(), "invalid.git")
+	runGit(t, workDir, "clone", "--quiet", "--bare", workDir, invalidDir)
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "file://" + filepath.ToSlash(invalidDir), Force: true})
+	if err == nil {
+		t.Fatal("want non-nil error, got nil")
+	}
+	if got := runGit(t, registryDir, "rev-parse", "HEAD"); got != before {
+		t.Errorf("got registry commit %s, want %s", got, before)
+	}
+	dotClient, err = client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateMissing},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateMissing},
+	})
+
+	// Uninstalling should remove the registry that was cloned
+	if err := dotClient.Uninstall(client.RestoreOptions{}); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if _, err := os.Stat(registryDir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want %s to not exist after uninstall, got %v", registryDir, err)
+	}
+}
+
+func TestSetupArchive(t *testing.T) {
+	homeDir := t.TempDir()
+	srcDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", srcDir)
+	archivePath := filepath.Join(t.TempDir(), "dotfiles.tar.gz")
+	writeTarGz(t, srcDir, archivePath)
+
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: archivePath})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if !dotClient.ArchiveChanged() {
+		t.Error("want archive to have changed since it has not been applied yet")
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	filesEqual(t, filepath.Join(homeDir, ".zshrc"), "testdata/registry-1/zsh/zshrc")
+	if dotClient.Archive() != archivePath || dotClient.ArchiveChanged() {
+		t.Errorf("got archive %s and changed %t, want %s and false", dotClient.Archive(), dotClient.ArchiveChanged(), archivePath)
+	}
+	err = dotClient.Add(filepath.Join(homeDir, ".gitconfig"), client.AddOptions{Name: "other"})
+	if !errors.Is(err, client.ErrRegistryReadOnly) {
+		t.Errorf("got error %v, want %v", err, client.ErrRegistryReadOnly)
+	}
+
+	// Replacing the archive should be detected
+	err = os.WriteFile(filepath.Join(srcDir, "zsh", "zshrc"), []byte("export EDITOR=vim\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	writeTarGz(t, srcDir, archivePath)
+	dotClient, err = client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if !dotClient.ArchiveChanged() {
+		t.Error("want archive to have changed")
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateClean},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateOutdated},
+	})
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, filepath.Join(homeDir, ".zshrc"), "export EDITOR=vim\n")
+	if dotClient.ArchiveChanged() {
+		t.Error("want archive to not have changed after applying")
+	}
+
+	// Archives can also be downloaded
+	archiveData, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dotfiles.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(archiveData)
+	}))
+	defer srv.Close()
+	homeDir = t.TempDir()
+	dotClient, err = client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: srv.URL + "/dotfiles.tar.gz"})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateMissing},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateMissing},
+	})
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: srv.URL + "/missing.tar.gz", Force: true})
+	if err == nil {
+		t.Error("want error, got nil")
+	}
+
+	// Downloading an archive that is invalid should leave the current archive in place
+	archiveData = []byte("not an archive")
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: srv.URL + "/dotfiles.tar.gz"})
+	if err == nil {
+		t.Error("want error, got nil")
+	}
+	dotClient, err = client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateMissing},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateMissing},
+	})
+
+	// Uninstalling should remove the archive that was downloaded
+	if err := dotClient.Uninstall(client.RestoreOptions{}); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	downloadPath := filepath.Join(homeDir, ".config", "dot", "registry.tar.gz")
+	if _, err := os.Stat(downloadPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want %s to not exist after uninstall, got %v", downloadPath, err)
+	}
+}
+
+func TestSetupLayers(t *testing.T) {
+	homeDir := t.TempDir()
+	registriesDir := t.TempDir()
+	teamDir := filepath.Join(registriesDir, "team")
+	personalDir := filepath.Join(registriesDir, "personal")
+	copyDir(t, "testdata/registry-1", teamDir)
+	if err := os.MkdirAll(personalDir, 0o755); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	zshrc := "export EDITOR=nvim\n"
+	if err := os.WriteFile(filepath.Join(personalDir, "zshrc"), []byte(zshrc), 0o644); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	cfg := "dotfiles:\n  zsh:\n    src: zshrc\n    dst: ~/.zshrc\n"
+	if err := os.WriteFile(filepath.Join(personalDir, "dot.yml"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: teamDir, Layers: []string{personalDir}})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	filesEqual(t, filepath.Join(homeDir, ".gitconfig"), "testdata/registry-1/git/gitconfig")
+	fileContentsEqual(t, filepath.Join(homeDir, ".zshrc"), zshrc)
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateClean, Layer: teamDir},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateClean, Layer: personalDir},
+	})
+
+	// New dotfiles are added to the highest layer
+	tmuxConf := "set -g mouse on\n"
+	if err := os.WriteFile(filepath.Join(homeDir, ".tmux.conf"), []byte(tmuxConf), 0o644); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Add(filepath.Join(homeDir, ".tmux.conf"), client.AddOptions{Name: "tmux"})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, filepath.Join(personalDir, "tmux", "tmux.conf"), tmuxConf)
+	filesEqual(t, filepath.Join(teamDir, "dot.yml"), "testdata/registry-1/dot.yml")
+
+	// Setting up with only the personal registry uses the team registry it extends
+	data, err := os.ReadFile(filepath.Join(personalDir, "dot.yml"))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	data = append([]byte("extends: ../team\n"), data...)
+	if err := os.WriteFile(filepath.Join(personalDir, "dot.yml"), data, 0o644); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: personalDir})
+	if !errors.Is(err, client.ErrSetup) {
+		t.Errorf("got error %v, want %v", err, client.ErrSetup)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: personalDir, Force: true})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateClean, Layer: teamDir},
+		{Name: "tmux", DstPath: filepath.Join(homeDir, ".tmux.conf"), State: client.StateClean, Layer: personalDir},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateClean, Layer: personalDir},
+	})
+
+	// Forgetting a dotfile removes it from the layer it comes from
+	err = dotClient.Forget(client.ForgetOptions{}, "git")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, filepath.Join(teamDir, "dot.yml"), "dotfiles:\n  zsh:\n    src: zsh/zshrc\n    dst: ~/.zshrc\n")
+}
+
+func TestApplyRollback(t *testing.T) {
+	homeDir := t.TempDir()
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "testdata/registry-5"})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	// bash is written first and creates ~/.profile as a directory,
+	// so writing profile fails and bash must be rolled back
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err == nil {
+		t.Fatal("want non-nil error, got nil")
+	}
+	if _, err := os.Lstat(filepath.Join(homeDir, ".profile")); !os.IsNotExist(err) {
+		t.Errorf("want .profile to not exist after rollback, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "bash", DstPath: filepath.Join(homeDir, ".profile", "bashrc"), State: client.StateMissing},
+		{Name: "profile", DstPath: filepath.Join(homeDir, ".profile"), State: client.StateMissing},
+	})
+}
+
+func TestPlan(t *testing.T) {
+	homeDir := t.TempDir()
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "testdata/registry-1"})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{}, "git")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = os.WriteFile(filepath.Join(homeDir, ".gitconfig"), []byte("[user]\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	got, err := dotClient.Plan(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	want := []client.Action{
+		{
+			Name:    "git",
+			DstPath: filepath.Join(homeDir, ".gitconfig"),
+			Type:    client.ActionBlocked,
+			Reason:  "destination was manually modified",
+		},
+		{
+			Name:    "zsh",
+			DstPath: filepath.Join(homeDir, ".zshrc"),
+			Type:    client.ActionCreate,
+			Reason:  "destination does not exist",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got actions %+v, want %+v", got, want)
+	}
+	// Make sure nothing was changed
+	if _, err := os.Stat(filepath.Join(homeDir, ".zshrc")); !os.IsNotExist(err) {
+		t.Errorf("want .zshrc to not exist after plan, got %v", err)
+	}
+
+	got, err = dotClient.Plan(client.ApplyOptions{Force: true}, "git")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if len(got) != 1 || got[0].Type != client.ActionOverwrite {
+		t.Errorf("got actions %+v, want git to be overwritten", got)
+	}
+
+	// Plan must reject the same options as Apply
+	opts := client.ApplyOptions{Force: true, Merge: true}
+	_, planErr := dotClient.Plan(opts)
+	applyErr := dotClient.Apply(opts)
+	if planErr == nil || applyErr == nil || planErr.Error() != applyErr.Error() {
+		t.Errorf("want Plan and Apply to return the same error, got %v and %v", planErr, applyErr)
+	}
+}
+
+func TestApplyPrune(t *testing.T) {
+	homeDir := t.TempDir()
+	registryDir := t.TempDir()
+	copyDir(t, "testdata/registry-4", registryDir)
+	copyDir(t, "testdata/registry-1", registryDir)
+	cfg := `dotfiles:
+  git:
+    src: git/gitconfig
+    dst: ~/.gitconfig
+  nvim:
+    src: nvim
+    dst: ~/.config/nvim
+  zsh:
+    src: zsh/zshrc
+    dst: ~/.zshrc
+`
+	err := os.WriteFile(filepath.Join(registryDir, "dot.yml"), []byte(cfg), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	// Remove all the dotfiles except git from the registry, and modify zsh so it can't be pruned
+	cfg = "dotfiles:\n  git:\n    src: git/gitconfig\n    dst: ~/.gitconfig\n"
+	err = os.WriteFile(filepath.Join(registryDir, "dot.yml"), []byte(cfg), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = os.WriteFile(filepath.Join(homeDir, ".zshrc"), []byte("export EDITOR=nvim\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	dotClient, err = client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateClean},
+		{Name: "nvim", DstPath: filepath.Join(homeDir, ".config", "nvim"), State: client.StateOrphaned},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateOrphaned},
+	})
+	actions, err := dotClient.Plan(client.ApplyOptions{Prune: true})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	var gotTypes []client.ActionType
+	for _, a := range actions {
+		gotTypes = append(gotTypes, a.Type)
+	}
+	wantTypes := []client.ActionType{client.ActionSkipUnchanged, client.ActionPrune, client.ActionOrphaned}
+	if !reflect.DeepEqual(gotTypes, wantTypes) {
+		t.Errorf("got action types %v, want %v", gotTypes, wantTypes)
+	}
+
+	// Without prune nothing is removed
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	filesEqual(t, filepath.Join(homeDir, ".config", "nvim", "init.vim"), "testdata/registry-4/nvim/init.vim")
+
+	// Empty directories that weren't created by dot should be left alone
+	nvimDir := filepath.Join(homeDir, ".config", "nvim")
+	userDir := filepath.Join(nvimDir, "undo")
+	if err := os.Mkdir(userDir, 0o755); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{Prune: true})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	for _, p := range []string{filepath.Join(nvimDir, "init.vim"), filepath.Join(nvimDir, "lua")} {
+		if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("want %s to be removed, got %v", p, err)
+		}
+	}
+	if _, err := os.Stat(userDir); err != nil {
+		t.Errorf("want %s to still exist after pruning, got %v", userDir, err)
+	}
+	fileContentsEqual(t, filepath.Join(homeDir, ".zshrc"), "export EDITOR=nvim\n")
+	orphans, err := dotClient.Orphans()
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if want := []string{"zsh"}; !reflect.DeepEqual(orphans, want) {
+		t.Errorf("got orphans %v, want %v", orphans, want)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	homeDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(homeDir, ".zshrc"), []byte(`export PATH="/usr/local/bin:$PATH"`), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "testdata/registry-1"})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateMissing},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateOutdated},
+	})
+
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateClean},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateClean},
+	})
+
+	err = os.WriteFile(filepath.Join(homeDir, ".zshrc"), []byte(`export EDITOR=vim`), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = os.Remove(filepath.Join(homeDir, ".gitconfig"))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateMissing},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateModified},
+	})
+}
+
+func TestStatusConditions(t *testing.T) {
+	homeDir := t.TempDir()
+	registryDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", registryDir)
+	otherArch := "arm64"
+	if runtime.GOARCH == otherArch {
+		otherArch = "amd64"
+	}
+	cfg := fmt.Sprintf(`dotfiles:
+  arch:
+    src: git/gitconfig
+    dst: ~/.arch
+    when:
+      arch: [%s]
+  command:
+    src: git/gitconfig
+    dst: ~/.command
+    when:
+      command: [dot-test-command]
+  env:
+    src: zsh/zshrc
+    dst: ~/.env
+    when:
+      env: [DOT_TEST_ENV]
+      hostname: ["*"]
+  missingenv:
+    src: zsh/zshrc
+    dst: ~/.missingenv
+    when:
+      env: [DOT_TEST_MISSING_ENV]
+`, otherArch)
+	err := os.WriteFile(filepath.Join(registryDir, "dot.yml"), []byte(cfg), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	binDir := t.TempDir()
+	err = os.WriteFile(filepath.Join(binDir, "dot-test-command"), []byte("#!/bin/sh\n"), 0o755)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	t.Setenv("PATH", binDir)
+	t.Setenv("DOT_TEST_ENV", "1")
+
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	want := []client.DotfileStatus{
+		{
+			Name:    "arch",
+			DstPath: filepath.Join(homeDir, ".arch"),
+			State:   client.StateUnsupported,
+			Reason:  fmt.Sprintf("not supported on %s architecture", runtime.GOARCH),
+		},
+		{Name: "command", DstPath: filepath.Join(homeDir, ".command"), State: client.StateMissing},
+		{Name: "env", DstPath: filepath.Join(homeDir, ".env"), State: client.StateMissing},
+		{
+			Name:    "missingenv",
+			DstPath: filepath.Join(homeDir, ".missingenv"),
+			State:   client.StateUnsupported,
+			Reason:  "none of the environment variables DOT_TEST_MISSING_ENV are set",
+		},
+	}
+	if runtime.GOOS == "windows" {
+		// Executables need an extension on windows
+		want[1].State = client.StateUnsupported
+		want[1].Reason = "none of the commands dot-test-command were found in PATH"
+	}
+	statusesEqual(t, dotClient, want)
+
+	// Unsupported dotfiles are skipped when applying
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(homeDir, ".arch")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want %s to not exist, got %v", filepath.Join(homeDir, ".arch"), err)
+	}
+	filesEqual(t, filepath.Join(homeDir, ".env"), "testdata/registry-1/zsh/zshrc")
+}
+
+func TestDiff(t *testing.T) {
+	homeDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(homeDir, ".zshrc"), []byte("export EDITOR=vim\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "testdata/registry-1"})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	diffs, err := dotClient.Diff("zsh")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if len(diffs) != 1 {
+		t.Fatalf("got %d diffs, want 1", len(diffs))
+	}
+	dstPath := filepath.Join(homeDir, ".zshrc")
+	want := client.DotfileDiff{
+		Name:    "zsh",
+		SrcPath: "testdata/registry-1/zsh/zshrc",
+		DstPath: dstPath,
+		Unified: `--- ` + dstPath + `
++++ testdata/registry-1/zsh/zshrc
+@@ -1 +1 @@
+-export EDITOR=vim
++export PATH="$(go env GOPATH)/bin:$PATH"
+`,
+		Insertions: 1,
+		Deletions:  1,
+	}
+	if !reflect.DeepEqual(diffs[0], want) {
+		t.Errorf("got diff %+v, want %+v", diffs[0], want)
+	}
+
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	diffs, err = dotClient.Diff()
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	for _, d := range diffs {
+		if d.Unified != "" {
+			t.Errorf("got diff for %s after apply, want none:\n%s", d.Name, d.Unified)
+		}
+	}
+}
+
+func TestApplyTemplate(t *testing.T) {
+	homeDir := t.TempDir()
+	varsPath := filepath.Join(homeDir, ".config", "dot", "vars.yml")
+	err := os.MkdirAll(filepath.Dir(varsPath), 0o755)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = os.WriteFile(varsPath, []byte("editor: nvim\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "testdata/registry-2"})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(homeDir, ".gitconfig"))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	want := `[user]
+	email = dev@example.com
+[core]
+	editor = nvim
+[dot]
+	os = ` + runtime.GOOS + `
+`
+	if string(got) != want {
+		t.Errorf("got rendered dotfile %q, want %q", got, want)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateClean},
+	})
+
+	// Changing a variable should cause the dotfile to be outdated
+	err = os.WriteFile(varsPath, []byte("editor: emacs\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	dotClient, err = client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateOutdated},
+	})
+}
+
+func TestApplySymlink(t *testing.T) {
+	homeDir := t.TempDir()
+	vimrcPath := filepath.Join(homeDir, ".vimrc")
+	err := os.WriteFile(vimrcPath, []byte("set number\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "testdata/registry-3"})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	// Existing file should have been backed up
+	backups, err := dotClient.Backups("vim")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if len(backups) != 1 || backups[0].Reason != client.BackupReasonSetup {
+		t.Errorf("want 1 setup backup, got %+v", backups)
+	}
+
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	wantTarget, err := filepath.Abs("testdata/registry-3/vim/vimrc")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	gotTarget, err := os.Readlink(vimrcPath)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if gotTarget != wantTarget {
+		t.Errorf("got symlink target %s, want %s", gotTarget, wantTarget)
+	}
+	if info, err := os.Lstat(filepath.Join(homeDir, ".zshrc")); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("want .zshrc to be a regular file, got %v, %v", info, err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "vim", DstPath: vimrcPath, State: client.StateClean},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateClean},
+	})
+
+	// Replace the symlink with a regular file with the same contents, it should be detected as modified
+	if err := os.Remove(vimrcPath); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if err := copyFile(wantTarget, vimrcPath); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	actions, err := dotClient.Plan(client.ApplyOptions{}, "vim")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	wantActions := []client.Action{{
+		Name:    "vim",
+		DstPath: vimrcPath,
+		Type:    client.ActionBlocked,
+		Reason:  "destination symlink was replaced by a regular file",
+	}}
+	if !reflect.DeepEqual(actions, wantActions) {
+		t.Errorf("got actions %+v, want %+v", actions, wantActions)
+	}
+
+	err = dotClient.Apply(client.ApplyOptions{Force: true}, "vim")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if gotTarget, err := os.Readlink(vimrcPath); err != nil || gotTarget != wantTarget {
+		t.Errorf("got symlink target %s, %v, want %s", gotTarget, err, wantTarget)
+	}
+}
+
+func TestApplyDir(t *testing.T) {
+	homeDir := t.TempDir()
+	// Copy the registry so the source can be modified
+	registryDir := filepath.Join(t.TempDir(), "registry")
+	copyDir(t, "testdata/registry-4", registryDir)
+
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	dstDir := filepath.Join(homeDir, ".config", "nvim")
+	filesEqual(t, filepath.Join(dstDir, "init.vim"), filepath.Join(registryDir, "nvim", "init.vim"))
+	filesEqual(t, filepath.Join(dstDir, "lua", "plugins.lua"), filepath.Join(registryDir, "nvim", "lua", "plugins.lua"))
+	if _, err := os.Stat(filepath.Join(dstDir, "init.vim.swp")); !os.IsNotExist(err) {
+		t.Errorf("want ignored file to not exist, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "nvim", DstPath: dstDir, State: client.StateClean},
+	})
+
+	// Removing a file from the source should cause it to be pruned
+	if err := os.Remove(filepath.Join(registryDir, "nvim", "lua", "plugins.lua")); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "nvim", DstPath: dstDir, State: client.StateOutdated},
+	})
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "lua", "plugins.lua")); !os.IsNotExist(err) {
+		t.Errorf("want pruned file to not exist, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "lua")); !os.IsNotExist(err) {
+		t.Errorf("want directory of pruned file to not exist, got %v", err)
+	}
+
+	// Modifying a file in the destination should be detected
+	err = os.WriteFile(filepath.Join(dstDir, "init.vim"), []byte("set nonumber\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "nvim", DstPath: dstDir, State: client.StateModified},
+	})
+}
+
+func TestApplyPerm(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions are not supported on windows")
+	}
+	homeDir := t.TempDir()
+	registryDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", registryDir)
+	writeConfig := func(perm string) {
+		t.Helper()
+		cfg := "dotfiles:\n  git:\n    src: git/gitconfig\n    dst: ~/.gitconfig\n    perm: " + perm + "\n"
+		if err := os.WriteFile(filepath.Join(registryDir, "dot.yml"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+	}
+	permEqual := func(path string, want os.FileMode) {
+		t.Helper()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("got mode %#o, want %#o", info.Mode().Perm(), want)
+		}
+	}
+	writeConfig("0600")
+	gitconfigPath := filepath.Join(homeDir, ".gitconfig")
+
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	permEqual(gitconfigPath, 0o600)
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: gitconfigPath, State: client.StateClean},
+	})
+
+	// Changing the mode of the destination should be detected and fixed by apply
+	if err := os.Chmod(gitconfigPath, 0o644); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{{
+		Name:    "git",
+		DstPath: gitconfigPath,
+		State:   client.StateDrifted,
+		Reason:  "permissions were manually changed: mode is 0644 instead of 0600",
+	}})
+	actions, err := dotClient.Plan(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	wantActions := []client.Action{{
+		Name:    "git",
+		DstPath: gitconfigPath,
+		Type:    client.ActionOverwrite,
+		Reason:  "permissions were manually changed: mode is 0644 instead of 0600",
+	}}
+	if !reflect.DeepEqual(actions, wantActions) {
+		t.Errorf("got actions %+v, want %+v", actions, wantActions)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	permEqual(gitconfigPath, 0o600)
+	filesEqual(t, gitconfigPath, filepath.Join(registryDir, "git", "gitconfig"))
+
+	// Changing the mode in the registry should also be detected
+	writeConfig("0640")
+	dotClient, err = client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{{
+		Name:    "git",
+		DstPath: gitconfigPath,
+		State:   client.StateDrifted,
+		Reason:  "permissions changed in the registry: mode is 0600 instead of 0640",
+	}})
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	permEqual(gitconfigPath, 0o640)
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: gitconfigPath, State: client.StateClean},
+	})
+}
+
+func TestApplyHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks in this test use sh")
+	}
+	homeDir := t.TempDir()
+	registryDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", registryDir)
+	logPath := filepath.Join(t.TempDir(), "hooks.log")
+	gitconfigPath := filepath.Join(homeDir, ".gitconfig")
+	writeConfig := func(zshHook string) {
+		t.Helper()
+		cfg := fmt.Sprintf(`hooks:
+  pre_apply: echo "registry pre $DOT_DOTFILES" >> %[1]s
+  post_apply: echo "registry post $DOT_DOTFILES" >> %[1]s
+dotfiles:
+  git:
+    src: git/gitconfig
+    dst: ~/.gitconfig
+    hooks:
+      pre_apply: echo "git pre $DOT_ACTION $DOT_SRC" >> %[1]s
+      post_apply: echo "git post $DOT_ACTION $DOT_DST" >> %[1]s
+  zsh:
+    src: zsh/zshrc
+    dst: ~/.zshrc
+    hooks:
+      pre_apply: test -e %[3]s || echo "zsh pre" >> %[1]s
+      post_apply: %[2]s
+`, logPath, zshHook, gitconfigPath)
+		if err := os.WriteFile(filepath.Join(registryDir, "dot.yml"), []byte(cfg), 0o644); err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+	}
+	writeConfig("pwd >> " + logPath)
+	// Resolve symlinks since pwd prints the real path, ex: /tmp is a symlink on macOS
+	realRegistryDir, err := filepath.EvalSymlinks(registryDir)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	// All pre hooks should run before any dotfiles are written
+	wantLog := "registry pre git zsh\n" +
+		"git pre create " + filepath.Join(registryDir, "git", "gitconfig") + "\n" +
+		"zsh pre\n" +
+		"git post create " + gitconfigPath + "\n" +
+		realRegistryDir + "\n" +
+		"registry post git zsh\n"
+	fileContentsEqual(t, logPath, wantLog)
+
+	// Hooks should not run if nothing changed
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, logPath, wantLog)
+
+	// A failing hook should roll back all changes
+	if err := os.Remove(logPath); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	writeConfig("exit 1")
+	err = os.WriteFile(filepath.Join(registryDir, "zsh", "zshrc"), []byte("export EDITOR=vim\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	var hookOutput bytes.Buffer
+	dotClient, err = client.New(client.WithHomeDir(homeDir), client.WithHookOutput(&hookOutput))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: gitconfigPath, State: client.StateClean},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateOutdated},
+	})
+
+	err = dotClient.Apply(client.ApplyOptions{IgnoreHookErrors: true})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, filepath.Join(homeDir, ".zshrc"), "export EDITOR=vim\n")
+	fileContentsEqual(t, logPath, "registry pre zsh\nregistry pre zsh\nregistry post zsh\n")
+	if !strings.Contains(hookOutput.String(), `zsh post_apply hook "exit 1" failed, ignoring`) {
+		t.Errorf("want ignored hook failure to be reported, got %q", hookOutput.String())
+	}
+}
+
+func TestApplyMerge(t *testing.T) {
+	homeDir := t.TempDir()
+	registryDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", registryDir)
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	// Change the start of the source and the end of the destination
+	gitconfigPath := filepath.Join(homeDir, ".gitconfig")
+	srcPath := filepath.Join(registryDir, "git", "gitconfig")
+	err = os.WriteFile(srcPath, []byte("[pull]\n\tff = true\n\trebase = true\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = os.WriteFile(gitconfigPath, []byte("[pull]\n\tff = only\n\trebase = true\n[core]\n\teditor = vim\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	actions, err := dotClient.Plan(client.ApplyOptions{Merge: true}, "git")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if len(actions) != 1 || actions[0].Type != client.ActionMerge {
+		t.Errorf("got actions %+v, want git to be merged", actions)
+	}
+	err = dotClient.Apply(client.ApplyOptions{Merge: true})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, gitconfigPath, "[pull]\n\tff = true\n\trebase = true\n[core]\n\teditor = vim\n")
+	// The local changes are kept, so it is still modified, but nothing needs to be merged
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: gitconfigPath, State: client.StateModified},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateClean},
+	})
+	actions, err = dotClient.Plan(client.ApplyOptions{Merge: true}, "git")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if len(actions) != 1 || actions[0].Type != client.ActionSkipUnchanged {
+		t.Errorf("got actions %+v, want git to be skipped", actions)
+	}
+	backups, err := dotClient.Backups("git")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if len(backups) != 1 || backups[0].Reason != client.BackupReasonMerge {
+		t.Errorf("got backups %+v, want a merge backup", backups)
+	}
+
+	// Both change the same line
+	err = os.WriteFile(srcPath, []byte("[pull]\n\tff = false\n\trebase = true\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	local := "[pull]\n\tff = only\n\trebase = true\n[core]\n\teditor = vim\n"
+	err = os.WriteFile(gitconfigPath, []byte(local), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{Merge: true})
+	if !errors.Is(err, client.ErrMergeConflict) {
+		t.Errorf("got error %v, want %v", err, client.ErrMergeConflict)
+	}
+	fileContentsEqual(t, gitconfigPath, local)
+}
+
+func TestCapture(t *testing.T) {
+	homeDir := t.TempDir()
+	registryDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", registryDir)
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	zshrc := "export EDITOR=nvim\n"
+	err = os.WriteFile(filepath.Join(homeDir, ".zshrc"), []byte(zshrc), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Capture()
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, filepath.Join(registryDir, "zsh", "zshrc"), zshrc)
+	filesEqual(t, filepath.Join(registryDir, "git", "gitconfig"), "testdata/registry-1/git/gitconfig")
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateClean},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateClean},
+	})
+
+	// Can't capture if the source changed too
+	err = os.WriteFile(filepath.Join(registryDir, "git", "gitconfig"), []byte("[user]\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = os.WriteFile(filepath.Join(homeDir, ".gitconfig"), []byte("[core]\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Capture("git")
+	if err == nil {
+		t.Error("want non-nil error, got nil")
+	}
+	fileContentsEqual(t, filepath.Join(registryDir, "git", "gitconfig"), "[user]\n")
+}
+
+func TestCapturePerm(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions are not supported on windows")
+	}
+	homeDir := t.TempDir()
+	registryDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", registryDir)
+	cfg := "dotfiles:\n  git:\n    src: git/gitconfig\n    dst: ~/.gitconfig\n    perm: 0600\n"
+	if err := os.WriteFile(filepath.Join(registryDir, "dot.yml"), []byte(cfg), 0o644); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	gitconfigPath := filepath.Join(homeDir, ".gitconfig")
+	gitconfig := "[user]\n\tname = me\n"
+	if err := os.WriteFile(gitconfigPath, []byte(gitconfig), 0o600); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Capture("git")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, filepath.Join(registryDir, "git", "gitconfig"), gitconfig)
+	// The permissions are unchanged, so the dotfile should not be considered drifted
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: gitconfigPath, State: client.StateClean},
+	})
+}
+
+func TestCaptureTemplate(t *testing.T) {
+	homeDir := t.TempDir()
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "testdata/registry-2"})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = os.WriteFile(filepath.Join(homeDir, ".gitconfig"), []byte("[core]\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Capture("git")
+	if err == nil {
+		t.Error("want non-nil error, got nil")
+	}
+}
+
+func TestCaptureDir(t *testing.T) {
+	homeDir := t.TempDir()
+	registryDir := t.TempDir()
+	copyDir(t, "testdata/registry-4", registryDir)
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	nvimDir := filepath.Join(homeDir, ".config", "nvim")
+	err = os.WriteFile(filepath.Join(nvimDir, "init.vim"), []byte("set number\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = os.Remove(filepath.Join(nvimDir, "lua", "plugins.lua"))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Capture("nvim")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, filepath.Join(registryDir, "nvim", "init.vim"), "set number\n")
+	if _, err := os.Stat(filepath.Join(registryDir, "nvim", "lua", "plugins.lua")); !os.IsNotExist(err) {
+		t.Errorf("want plugins.lua to be removed from the registry, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "nvim", DstPath: nvimDir, State: client.StateClean},
+	})
+}
+
+func TestAdd(t *testing.T) {
+	homeDir := t.TempDir()
+	registryDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", registryDir)
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	tmuxConf := "set -g mouse on\n"
+	err = os.WriteFile(filepath.Join(homeDir, ".tmux.conf"), []byte(tmuxConf), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Add(filepath.Join(homeDir, ".tmux.conf"), client.AddOptions{Name: "tmux"})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, filepath.Join(registryDir, "tmux", "tmux.conf"), tmuxConf)
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateMissing},
+		{Name: "tmux", DstPath: filepath.Join(homeDir, ".tmux.conf"), State: client.StateClean},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateMissing},
+	})
+
+	// The new dotfile should be picked up when the registry is loaded again
+	dotClient, err = client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Add("~/.tmux.conf", client.AddOptions{Name: "tmux"})
+	if !errors.Is(err, dotfile.ErrExists) {
+		t.Errorf("got %v, want dotfile.ErrExists", err)
+	}
+
+	// Restoring should leave the file in place since it was never changed by dot
+	err = dotClient.Restore(client.RestoreOptions{}, "tmux")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, filepath.Join(homeDir, ".tmux.conf"), tmuxConf)
+}
+
+func TestAddSrcPath(t *testing.T) {
+	homeDir := t.TempDir()
+	registryDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", registryDir)
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join(homeDir, ".vimrc"), []byte("syntax on\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	// Source already exists
+	err = dotClient.Add(filepath.Join(homeDir, ".vimrc"), client.AddOptions{Name: "vim", SrcPath: "zsh/zshrc"})
+	if err == nil {
+		t.Error("want non-nil error, got nil")
+	}
+	err = dotClient.Add(filepath.Join(homeDir, ".vimrc"), client.AddOptions{Name: "vim", SrcPath: "../vimrc"})
+	if err == nil {
+		t.Error("want non-nil error, got nil")
+	}
+	filesEqual(t, filepath.Join(registryDir, "dot.yml"), "testdata/registry-1/dot.yml")
+
+	err = dotClient.Add(filepath.Join(homeDir, ".vimrc"), client.AddOptions{Name: "vim", SrcPath: "vimrc", OS: []string{"plan9"}})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, filepath.Join(registryDir, "dot.yml"), `dotfiles:
+  git:
+    src: git/gitconfig
+    dst: ~/.gitconfig
+  zsh:
+    src: zsh/zshrc
+    dst: ~/.zshrc
+  vim:
+    src: vimrc
+    dst: ~/.vimrc
+    os:
+      - plan9
+`)
+}
+
+func TestAddRollback(t *testing.T) {
+	homeDir := t.TempDir()
+	registryDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", registryDir)
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join(homeDir, ".tmux.conf"), []byte("set -g mouse on\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	// Make saving the merge base fail so adding fails after the backup is made
+	err = os.MkdirAll(filepath.Join(homeDir, ".config", "dot", "bases", "tmux", "sub"), 0o755)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Add(filepath.Join(homeDir, ".tmux.conf"), client.AddOptions{Name: "tmux"})
+	if err == nil {
+		t.Fatal("want non-nil error, got nil")
+	}
+	filesEqual(t, filepath.Join(registryDir, "dot.yml"), "testdata/registry-1/dot.yml")
+	if _, err := os.Stat(filepath.Join(registryDir, "tmux")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want %s to not exist, got %v", filepath.Join(registryDir, "tmux"), err)
+	}
+	backups, err := dotClient.Backups("tmux")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if len(backups) != 0 {
+		t.Errorf("want no backups, got %+v", backups)
+	}
+	if _, err := os.Stat(filepath.Join(homeDir, ".config", "dot", "backups", "tmux")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want backup dir to not exist, got %v", err)
+	}
+}
+
+func TestForget(t *testing.T) {
+	homeDir := t.TempDir()
+	registryDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", registryDir)
+	gitconfig := "[user]\n"
+	err := os.WriteFile(filepath.Join(homeDir, ".gitconfig"), []byte(gitconfig), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{Force: true})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	// Leave zsh in place, but delete its source
+	err = dotClient.Forget(client.ForgetOptions{DeleteSource: true}, "zsh")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	filesEqual(t, filepath.Join(homeDir, ".zshrc"), "testdata/registry-1/zsh/zshrc")
+	if _, err := os.Stat(filepath.Join(registryDir, "zsh")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want %s to be deleted, got %v", filepath.Join(registryDir, "zsh"), err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateClean},
+	})
+
+	// Restore git, but keep its source
+	err = dotClient.Forget(client.ForgetOptions{Restore: true}, "git")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, filepath.Join(homeDir, ".gitconfig"), gitconfig)
+	filesEqual(t, filepath.Join(registryDir, "git", "gitconfig"), "testdata/registry-1/git/gitconfig")
+	fileContentsEqual(t, filepath.Join(registryDir, "dot.yml"), "dotfiles: {}\n")
+
+	lfData, err := os.ReadFile(filepath.Join(homeDir, ".config", "dot", "dot.lock"))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	var lf struct {
+		Dotfiles map[string]interface{} `json:"dotfiles"`
+	}
+	if err := json.Unmarshal(lfData, &lf); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if len(lf.Dotfiles) != 0 {
+		t.Errorf("want no dotfiles in lockfile, got %v", lf.Dotfiles)
+	}
+}
+
+func TestForgetStale(t *testing.T) {
+	homeDir := t.TempDir()
+	registryDir := t.TempDir()
+	copyDir(t, "testdata/registry-1", registryDir)
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	// Remove zsh from dot.yml manually
+	cfg := "dotfiles:\n  git:\n    src: git/gitconfig\n    dst: ~/.gitconfig\n"
+	err = os.WriteFile(filepath.Join(registryDir, "dot.yml"), []byte(cfg), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	dotClient, err = client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Forget(client.ForgetOptions{Restore: true}, "zsh")
+	if err == nil {
+		t.Error("want non-nil error, got nil")
+	}
+	err = dotClient.Forget(client.ForgetOptions{}, "zsh")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, filepath.Join(registryDir, "dot.yml"), cfg)
+	err = dotClient.Forget(client.ForgetOptions{}, "zsh")
+	if !errors.Is(err, dotfile.ErrNotFound) {
+		t.Errorf("got %v, want dotfile.ErrNotFound", err)
+	}
+}
+
+func TestForgetRollback(t *testing.T) {
+	homeDir := t.TempDir()
+	registryDir := t.TempDir()
+	copyDir(t, "testdata/registry-4", registryDir)
+	colorsDir := filepath.Join(registryDir, "nvim", "colors")
+	if err := os.Mkdir(colorsDir, 0o755); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: registryDir})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	// Make removing the merge base fail so forgetting fails after the source is deleted
+	err = os.MkdirAll(filepath.Join(homeDir, ".config", "dot", "bases", "nvim", "sub"), 0o755)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Forget(client.ForgetOptions{DeleteSource: true}, "nvim")
+	if err == nil {
+		t.Fatal("want non-nil error, got nil")
+	}
+	filesEqual(t, filepath.Join(registryDir, "nvim", "lua", "plugins.lua"), "testdata/registry-4/nvim/lua/plugins.lua")
+	if info, err := os.Stat(colorsDir); err != nil || !info.IsDir() {
+		t.Errorf("want %s to be recreated, got %v", colorsDir, err)
+	}
+	filesEqual(t, filepath.Join(registryDir, "dot.yml"), "testdata/registry-4/dot.yml")
+}
+
+func TestRestore(t *testing.T) {
+	homeDir := t.TempDir()
+	gitconfig := "[pull]\n\tff = only\n"
+	err := os.WriteFile(filepath.Join(homeDir, ".gitconfig"), []byte(gitconfig), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	nvimDir := filepath.Join(homeDir, ".config", "nvim")
+	if err := os.MkdirAll(nvimDir, 0o755); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	for name, data := range map[string]string{"init.vim": "syntax on\n", "unmanaged.vim": "set hidden\n"} {
+		if err := os.WriteFile(filepath.Join(nvimDir, name), []byte(data), 0o644); err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+	}
+
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "testdata/registry-1"})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	err = dotClient.Restore(client.RestoreOptions{}, "git")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, filepath.Join(homeDir, ".gitconfig"), gitconfig)
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateNotSetup},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateClean},
+	})
+
+	err = dotClient.Uninstall(client.RestoreOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if dotClient.IsSetup() {
+		t.Error("want dot to not be setup, but it is")
+	}
+	if _, err := os.Stat(filepath.Join(homeDir, ".zshrc")); !os.IsNotExist(err) {
+		t.Errorf("want .zshrc to not exist after uninstall, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(homeDir, ".config", "dot", "dot.lock")); !os.IsNotExist(err) {
+		t.Errorf("want lockfile to not exist after uninstall, got %v", err)
+	}
+
+	// Now do the same with a directory dotfile
+	dotClient, err = client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "testdata/registry-4"})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{Force: true})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	// Empty directories that weren't created by dot should be left alone
+	userDir := filepath.Join(nvimDir, "undo")
+	if err := os.Mkdir(userDir, 0o755); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Restore(client.RestoreOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, filepath.Join(nvimDir, "init.vim"), "syntax on\n")
+	fileContentsEqual(t, filepath.Join(nvimDir, "unmanaged.vim"), "set hidden\n")
+	if _, err := os.Stat(filepath.Join(nvimDir, "lua")); !os.IsNotExist(err) {
+		t.Errorf("want lua dir to not exist after restore, got %v", err)
+	}
+	if _, err := os.Stat(userDir); err != nil {
+		t.Errorf("want %s to still exist after restore, got %v", userDir, err)
+	}
+}
+
+func TestBackups(t *testing.T) {
+	homeDir := t.TempDir()
+	gitconfigPath := filepath.Join(homeDir, ".gitconfig")
+	err := os.WriteFile(gitconfigPath, []byte("[pull]\n\tff = only\n"), 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	dotClient, err := client.New(client.WithHomeDir(homeDir), client.WithBackupRetention(2))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "testdata/registry-1"})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	// Each forced apply over a modification should create a backup
+	for _, data := range []string{"[user]\n", "[core]\n"} {
+		if err := os.WriteFile(gitconfigPath, []byte(data), 0o644); err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+		if err := dotClient.Apply(client.ApplyOptions{Force: true}, "git"); err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+	}
+	backups, err := dotClient.Backups()
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	// The oldest force apply backup should have been pruned but the setup backup kept
+	if len(backups) != 2 {
+		t.Fatalf("got %d backups, want 2: %+v", len(backups), backups)
+	}
+	if backups[0].Reason != client.BackupReasonSetup || backups[1].Reason != client.BackupReasonForceApply {
+		t.Errorf("got backups %+v, want setup and force apply backups", backups)
+	}
+	for _, b := range backups {
+		if b.Name != "git" {
+			t.Errorf("got backup of %s, want git", b.Name)
+		}
+	}
+	backupPath, err := dotClient.BackupPath("git", backups[1].ID)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, backupPath, "[core]\n")
+	_, err = dotClient.BackupPath("git", "nope")
+	if !errors.Is(err, client.ErrBackupNotFound) {
+		t.Errorf("got error %v, want %v", err, client.ErrBackupNotFound)
+	}
+
+	err = dotClient.RestoreBackup("git", backups[1].ID)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, gitconfigPath, "[core]\n")
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: gitconfigPath, State: client.StateModified},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateClean},
+	})
+	backups, err = dotClient.Backups("git")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if len(backups) != 2 || backups[1].Reason != client.BackupReasonRestore {
+		t.Errorf("got backups %+v, want latest backup to be from restore", backups)
+	}
+
+	// Restore should still use the setup backup, but only if forced since git was modified
+	err = dotClient.Restore(client.RestoreOptions{}, "git")
+	if !errors.Is(err, client.ErrModified) {
+		t.Errorf("got error %v, want %v", err, client.ErrModified)
+	}
+	fileContentsEqual(t, gitconfigPath, "[core]\n")
+	err = dotClient.Restore(client.RestoreOptions{Force: true}, "git")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, gitconfigPath, "[pull]\n\tff = only\n")
+
+	// The modifications that were overwritten by restoring should be backed up
+	backups, err = dotClient.Backups("git")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if len(backups) != 2 || backups[1].Reason != client.BackupReasonForceRestore {
+		t.Fatalf("got backups %+v, want latest backup to be from force restore", backups)
+	}
+	backupPath, err = dotClient.BackupPath("git", backups[1].ID)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	fileContentsEqual(t, backupPath, "[core]\n")
+}
+
+func TestHashMigration(t *testing.T) {
+	homeDir := t.TempDir()
+	registryDir, err := filepath.Abs("testdata/registry-1")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	gitconfig, err := os.ReadFile(filepath.Join(registryDir, "git", "gitconfig"))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	zshrc, err := os.ReadFile(filepath.Join(registryDir, "zsh", "zshrc"))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(homeDir, ".gitconfig"), gitconfig, 0o644); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(homeDir, ".zshrc"), []byte("export EDITOR=vim\n"), 0o644); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	// Lockfile from before the hash algorithm was recorded, which always used md5
+	md5Hex := func(data []byte) string {
+		hash := md5.Sum(data)
+		return hex.EncodeToString(hash[:])
+	}
+	lf := map[string]interface{}{
+		"registryDir": registryDir,
+		"dotfiles": map[string]interface{}{
+			"git": map[string]string{"dstHash": md5Hex(gitconfig)},
+			"zsh": map[string]string{"dstHash": md5Hex(zshrc)},
+		},
+	}
+	lfp := filepath.Join(homeDir, ".config", "dot", "dot.lock")
+	writeJSON(t, lfp, lf)
+
+	dotClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	statusesEqual(t, dotClient, []client.DotfileStatus{
+		{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateClean},
+		{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateModified},
+	})
+	err = dotClient.Apply(client.ApplyOptions{}, "git")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	var got struct {
+		Dotfiles map[string]struct {
+			DstHash  string `json:"dstHash"`
+			HashAlgo string `json:"hashAlgo"`
+		} `json:"dotfiles"`
+	}
+	data, err := os.ReadFile(lfp)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	sha := sha256.Sum256(gitconfig)
+	if git := got.Dotfiles["git"]; git.HashAlgo != "sha256" || git.DstHash != hex.EncodeToString(sha[:]) {
+		t.Errorf("got git lockfile entry %+v, want it to be migrated to sha256", git)
+	}
+	// zsh was modified so it can't be migrated yet
+	if zsh := got.Dotfiles["zsh"]; zsh.HashAlgo != "md5" || zsh.DstHash != md5Hex(zshrc) {
+		t.Errorf("got zsh lockfile entry %+v, want it to still use md5", zsh)
+	}
+}
+
+func TestLockfileVersions(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		// version is the version of the fixture
+		version int
+		// migrated is whether or not the lockfile should be migrated
+		migrated bool
+		wantErr  error
+	}{
+		{"version 0", "v0.lock", 0, true, nil},
+		{"version 0 with hash algorithm", "v0-hashalgo.lock", 0, true, nil},
+		{"version 1", "v1.lock", 1, true, nil},
+		{"version 2", "v2.lock", 2, false, nil},
+		{"newer version", "v3.lock", 3, false, client.ErrLockfileVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			homeDir := t.TempDir()
+			if err := copyFile("testdata/registry-1/git/gitconfig", filepath.Join(homeDir, ".gitconfig")); err != nil {
+				t.Fatalf("want nil error, got %v", err)
+			}
+			if err := copyFile("testdata/registry-1/zsh/zshrc", filepath.Join(homeDir, ".zshrc")); err != nil {
+				t.Fatalf("want nil error, got %v", err)
+			}
+			original, err := os.ReadFile(filepath.Join("testdata", "lockfiles", tt.fixture))
+			if err != nil {
+				t.Fatalf("want nil error, got %v", err)
+			}
+			lfp := filepath.Join(homeDir, ".config", "dot", "dot.lock")
+			if err := os.MkdirAll(filepath.Dir(lfp), 0o755); err != nil {
+				t.Fatalf("want nil error, got %v", err)
+			}
+			if err := os.WriteFile(lfp, original, 0o644); err != nil {
+				t.Fatalf("want nil error, got %v", err)
+			}
+
+			dotClient, err := client.New(client.WithHomeDir(homeDir))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				// Make sure the lockfile wasn't touched
+				fileContentsEqual(t, lfp, string(original))
+				return
+			}
+			if err != nil {
+				t.Fatalf("want nil error, got %v", err)
+			}
+			statusesEqual(t, dotClient, []client.DotfileStatus{
+				{Name: "git", DstPath: filepath.Join(homeDir, ".gitconfig"), State: client.StateClean},
+				{Name: "zsh", DstPath: filepath.Join(homeDir, ".zshrc"), State: client.StateClean},
+			})
+			// The migrated lockfile is only saved once the lock is held
+			fileContentsEqual(t, lfp, string(original))
+			if err := dotClient.Apply(client.ApplyOptions{}); err != nil {
+				t.Fatalf("want nil error, got %v", err)
+			}
+
+			var lf struct {
+				Version int `json:"version"`
+			}
+			data, err := os.ReadFile(lfp)
+			if err != nil {
+				t.Fatalf("want nil error, got %v", err)
+			}
+			if err := json.Unmarshal(data, &lf); err != nil {
+				t.Fatalf("want nil error, got %v", err)
+			}
+			if lf.Version != 2 {
+				t.Errorf("got lockfile version %d, want 2", lf.Version)
+			}
+			backupPath := fmt.Sprintf("%s.v%d.bak", lfp, tt.version)
+			if tt.migrated {
+				fileContentsEqual(t, backupPath, string(original))
+			} else if _, err := os.Stat(backupPath); !os.IsNotExist(err) {
+				t.Errorf("want no lockfile backup, got %v", err)
+			}
+		})
+	}
+}
+
+func statusesEqual(t *testing.T, dotClient *client.Client, want []client.DotfileStatus) {
+	t.Helper()
+	got, err := dotClient.Status()
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got statuses %+v, want %+v", got, want)
+	}
+}
+
+func fileContentsEqual(t *testing.T, path, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %s: %v", path, err)
+	}
+	if string(got) != want {
+		t.Errorf("got contents %q for %s, want %q", got, path, want)
+	}
+}
+
 func filesEqual(t *testing.T, gotPath, wantPath string) {
 	gotData, err := os.ReadFile(gotPath)
 	if err != nil {
@@ -68,3 +2153,95 @@ func filesEqual(t *testing.T, gotPath, wantPath string) {
 		t.Errorf("files not equal: got %q, want %q", gotData, wantData)
 	}
 }
+
+func writeJSON(t *testing.T, path string, v interface{}) {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+}
+
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0o644)
+}
+
+func copyDir(t *testing.T, src, dst string) {
+	t.Helper()
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0o755)
+		}
+		return copyFile(path, filepath.Join(dst, rel))
+	})
+	if err != nil {
+		t.Fatalf("failed to copy %s to %s: %v", src, dst, err)
+	}
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=dot", "-c", "user.email=dot@example.com"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// writeTarGz writes a gzipped tar archive containing the files in dir to path.
+func writeTarGz(t *testing.T, dir, path string) {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: filepath.ToSlash(rel), Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to create archive of %s: %v", dir, err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+}
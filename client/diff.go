@@ -0,0 +1,102 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/cszatmary/dot/internal/diff"
+	"github.com/pkg/errors"
+)
+
+// DotfileDiff contains the differences between the destination of a dotfile
+// and its source in the registry.
+type DotfileDiff struct {
+	// Name is the name of the dotfile.
+	Name string
+	// SrcPath is the path to the dotfile source within the registry directory.
+	SrcPath string
+	// DstPath is the path to the dotfile destination with '~' expanded.
+	DstPath string
+	// Unified is a unified diff of the changes that would be made to the destination
+	// if the source was applied. It is empty if there are no differences.
+	Unified string
+	// Insertions is the number of lines the source adds to the destination.
+	Insertions int
+	// Deletions is the number of lines the source removes from the destination.
+	Deletions int
+}
+
+// Diff returns the differences between the destination of each dotfile and its source.
+// Optionally, a list of dotfile names can be provided to only diff specific dotfiles.
+// If no names are provided, all dotfiles will be diffed. Dotfiles that do not support
+// the current OS are skipped.
+//
+// The diffs are from the perspective of applying the dotfile, i.e. lines that are only
+// in the source are insertions and lines that are only in the destination are deletions.
+func (c *Client) Diff(names ...string) ([]DotfileDiff, error) {
+	dfs, err := c.dotfiles(names...)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []DotfileDiff
+	for _, df := range dfs {
+		reason, err := c.checkPlatform(df)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			c.debugger.Debugf("Skipping %s: %s", df.Name, reason)
+			continue
+		}
+		d := DotfileDiff{
+			Name:    df.Name,
+			SrcPath: filepath.Join(c.layerDir(df), df.SrcPath),
+			DstPath: expandTilde(df.DstPath, c.homeDir),
+		}
+		if !df.IsDir {
+			src, _, err := c.readSource(df)
+			if err != nil {
+				return nil, err
+			}
+			if err := d.add(d.DstPath, d.SrcPath, src); err != nil {
+				return nil, err
+			}
+			diffs = append(diffs, d)
+			continue
+		}
+
+		// Diff each file in the directory, the diffs are concatenated together
+		files, err := c.readSourceDir(df)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			rel := filepath.FromSlash(f.rel)
+			if err := d.add(filepath.Join(d.DstPath, rel), filepath.Join(d.SrcPath, rel), f.data); err != nil {
+				return nil, err
+			}
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs, nil
+}
+
+// add computes the diff between the file at dstPath and src and adds it to d.
+func (d *DotfileDiff) add(dstPath, srcPath string, src []byte) error {
+	// A missing destination is treated as an empty file, like how new files are shown by git
+	dstName := dstPath
+	dst, err := os.ReadFile(dstPath)
+	if errors.Is(err, os.ErrNotExist) {
+		dstName = "/dev/null"
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to read file %s", dstPath)
+	}
+
+	edits := diff.Diff(diff.Lines(string(dst)), diff.Lines(string(src)))
+	stat := diff.Stats(edits)
+	d.Unified += diff.UnifiedEdits(dstName, srcPath, edits)
+	d.Insertions += stat.Insertions
+	d.Deletions += stat.Deletions
+	return nil
+}
@@ -0,0 +1,226 @@
+package client
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cszatmary/dot/dotfile"
+	"github.com/pkg/errors"
+)
+
+// sourceFile is a file within the source directory of a dotfile.
+type sourceFile struct {
+	// rel is the path of the file relative to the source directory. It uses '/' as the separator.
+	rel  string
+	data []byte
+	perm fs.FileMode
+}
+
+// readSourceDir reads all the files in the source directory of df.
+// Templated files are rendered.
+func (c *Client) readSourceDir(df dotfile.Dotfile) ([]sourceFile, error) {
+	rels, err := c.registry.DotfileFiles(df.Name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get files of dotfile %s", df.Name)
+	}
+	files := make([]sourceFile, len(rels))
+	for i, rel := range rels {
+		f, err := c.registry.OpenDotfileFile(df.Name, rel)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open source file %s", rel)
+		}
+		data, perm, err := c.readSourceFile(df, path.Join(df.SrcPath, rel), f)
+		if err != nil {
+			return nil, err
+		}
+		files[i] = sourceFile{rel, data, perm}
+	}
+	return files, nil
+}
+
+// checkDir is like checkDotfile but for dotfiles whose source is a directory
+// and are installed by copying. The hash of each file is compared individually.
+// A file is considered modified if its hash differs from the one in the lockfile,
+// including if it was deleted or if it was created when it was not in the lockfile.
+func (c *Client) checkDir(check dotfileCheck) (dotfileCheck, error) {
+	df := check.df
+	srcFiles, err := c.readSourceDir(df)
+	if err != nil {
+		return check, err
+	}
+	info, err := os.Lstat(df.DstPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return hashSourceDir(check, srcFiles), nil
+	}
+	if err != nil {
+		return check, errors.Wrapf(err, "failed to get info of %s", df.DstPath)
+	}
+	check.dstExists = true
+	check.dstIsSymlink = info.Mode()&fs.ModeSymlink != 0
+	if !info.IsDir() {
+		// Was replaced with something that isn't a directory
+		check.modified = true
+		return hashSourceDir(check, srcFiles), nil
+	}
+
+	rels := make(map[string]bool)
+	for rel := range check.info.Files {
+		rels[rel] = true
+	}
+	for _, f := range srcFiles {
+		rels[f.rel] = true
+	}
+	for rel := range rels {
+		hash, _, err := hashDst(check.info.algo(), filepath.Join(df.DstPath, filepath.FromSlash(rel)))
+		if err != nil {
+			return check, err
+		}
+		if hash != check.info.Files[rel] {
+			c.debugger.Debugf("%s was modified in %s", rel, df.DstPath)
+			check.modified = true
+		}
+	}
+	if !check.modified && check.info.algo() != defaultHashAlgo {
+		// The files are what dot last wrote, so they can be rehashed to migrate the hashes
+		c.debugger.Debugf("Migrating hashes of %s from %s to %s", df.Name, check.info.algo(), defaultHashAlgo)
+		dfInfo := dotfileInfo{
+			HashAlgo: defaultHashAlgo,
+			Files:    make(map[string]string, len(check.info.Files)),
+			DstPath:  check.info.DstPath,
+			Perm:     check.info.Perm,
+			Owner:    check.info.Owner,
+			Group:    check.info.Group,
+		}
+		for rel := range check.info.Files {
+			dfInfo.Files[rel], _, err = hashDst(defaultHashAlgo, filepath.Join(df.DstPath, filepath.FromSlash(rel)))
+			if err != nil {
+				return check, err
+			}
+		}
+		dfInfo.DstHash = hashFiles(defaultHashAlgo, dfInfo.Files)
+		c.lf.Dotfiles[df.Name] = dfInfo
+		check.info = dfInfo
+	}
+	return hashSourceDir(check, srcFiles), nil
+}
+
+// hashSourceDir sets the source hashes of check using the algorithm from the lockfile info
+// and determines if the dotfile is outdated.
+func hashSourceDir(check dotfileCheck, srcFiles []sourceFile) dotfileCheck {
+	algo := check.info.algo()
+	check.srcFiles = make(map[string]string, len(srcFiles))
+	for _, f := range srcFiles {
+		check.srcFiles[f.rel] = hashData(algo, f.data)
+	}
+	check.srcHash = hashFiles(algo, check.srcFiles)
+	check.outdated = check.srcHash != check.info.DstHash
+	return check
+}
+
+// stageDir is like stageDotfile but for dotfiles whose source is a directory.
+func (c *Client) stageDir(s stagedDotfile) (stagedDotfile, error) {
+	var err error
+	s.files, err = c.readSourceDir(s.check.df)
+	if err != nil {
+		return s, err
+	}
+	if s.check.attrs.perm != 0 {
+		for i := range s.files {
+			s.files[i].perm = s.check.attrs.perm
+		}
+	}
+	if !s.check.df.Prune {
+		return s, nil
+	}
+	for rel := range s.check.info.Files {
+		if _, ok := s.check.srcFiles[rel]; !ok {
+			s.prune = append(s.prune, rel)
+		}
+	}
+	sort.Strings(s.prune)
+	return s, nil
+}
+
+// writeDir writes all the files of a staged directory dotfile as part of tx.
+func (s stagedDotfile) writeDir(tx *transaction) error {
+	dst := s.check.df.DstPath
+	// If the destination is not a directory it needs to be removed first
+	info, err := os.Lstat(dst)
+	if err == nil && !info.IsDir() {
+		if err := tx.remove(dst); err != nil {
+			return err
+		}
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrapf(err, "failed to get info of %s", dst)
+	}
+
+	for _, f := range s.files {
+		p := filepath.Join(dst, filepath.FromSlash(f.rel))
+		if err := tx.writeFile(p, f.data, f.perm); err != nil {
+			return err
+		}
+		if err := s.check.attrs.setOwner(tx, p); err != nil {
+			return err
+		}
+	}
+	for _, rel := range s.prune {
+		p := filepath.Join(dst, filepath.FromSlash(rel))
+		tx.debugger.Debugf("Pruning %s", p)
+		if err := tx.remove(p); err != nil {
+			return err
+		}
+	}
+	// Remove directories that only contained pruned files, dst is kept since it is still managed
+	return removeParentDirs(tx, dst, s.prune)
+}
+
+// backupDir creates a backup in backupDir of each file in rels that exists in dstDir.
+// It returns the hashes of the files that were backed up using defaultHashAlgo.
+func backupDir(dstDir, backupDir string, rels []string) (map[string]string, error) {
+	// Always create backupDir so it is known that dstDir was a directory, even if it had none of the files
+	if err := os.MkdirAll(backupDir, 0o755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create directory %s", backupDir)
+	}
+	files := make(map[string]string)
+	for _, rel := range rels {
+		if _, ok := files[rel]; ok {
+			continue
+		}
+		p := filepath.Join(dstDir, filepath.FromSlash(rel))
+		hash, exists, err := hashDst(defaultHashAlgo, p)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		backupPath := filepath.Join(backupDir, filepath.FromSlash(rel))
+		if err := backupFile(p, backupPath); err != nil {
+			return nil, errors.Wrapf(err, "failed to backup %s to %s", p, backupPath)
+		}
+		files[rel] = hash
+	}
+	return files, nil
+}
+
+// hashFiles returns a single hash representing all the files in a directory.
+// files is a map of file paths to the hash of each file.
+func hashFiles(algo hashAlgo, files map[string]string) string {
+	rels := make([]string, 0, len(files))
+	for rel := range files {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	var sb strings.Builder
+	for _, rel := range rels {
+		sb.WriteString(rel)
+		sb.WriteByte(0)
+		sb.WriteString(files[rel])
+		sb.WriteByte('\n')
+	}
+	return hashData(algo, []byte(sb.String()))
+}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cszatmary/dot/dotfile"
+	"github.com/pkg/errors"
+)
+
+// ForgetOptions configures what Forget does with the files of a dotfile.
+type ForgetOptions struct {
+	// DeleteSource deletes the dotfile source from the registry.
+	DeleteSource bool
+	// Restore restores the backup that was made when the dotfile was setup, like Restore does.
+	// Otherwise the destination is left as is.
+	Restore bool
+	// Force restores dotfiles even if they were manually modified, like RestoreOptions.Force.
+	// It is only used if Restore is true.
+	Force bool
+}
+
+// Forget stops managing the given dotfiles by removing them from the registry's `dot.yml`
+// and from the lockfile. By default the dotfile sources and destinations are left in place.
+//
+// Dotfiles that are only in the lockfile, because they were removed from `dot.yml` manually,
+// can also be forgotten. Their destinations cannot be restored since dot no longer knows where they are.
+// Like Apply, Forget is atomic. If any dotfile fails to be forgotten, all changes are rolled back.
+func (c *Client) Forget(opts ForgetOptions, names ...string) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if len(names) == 0 {
+		return errors.New("no dotfiles provided to forget")
+	}
+
+	// Each dotfile is removed from the dot.yml of the registry layer it comes from
+	cfgs := make(map[string]*layerConfig)
+	var cfgDirs []string
+	var dfs, modifiedDfs []dotfile.Dotfile
+	for _, name := range names {
+		retrieved, err := c.registry.Dotfiles(name)
+		if errors.Is(err, dotfile.ErrNotFound) {
+			if _, ok := c.lf.Dotfiles[name]; !ok {
+				return errors.Wrap(err, "failed to get dotfiles from registry")
+			}
+			if opts.Restore {
+				return errors.Errorf("cannot restore %s since it is no longer in the registry", name)
+			}
+			c.debugger.Debugf("Dotfile %s is no longer in the registry, removing it from the lockfile", name)
+			continue
+		} else if err != nil {
+			return errors.Wrap(err, "failed to get dotfiles from registry")
+		}
+		if _, ok := c.lf.Dotfiles[name]; !ok && opts.Restore {
+			return errors.Wrapf(ErrNotSetup, "cannot restore %s", name)
+		}
+		if opts.Restore {
+			modified, err := c.checkRestorable(retrieved[0], opts.Force)
+			if err != nil {
+				return err
+			}
+			if modified {
+				modifiedDfs = append(modifiedDfs, retrieved[0])
+			}
+		}
+		dir := c.layerDir(retrieved[0])
+		if err := c.checkWritable(dir); err != nil {
+			return err
+		}
+		cfg, ok := cfgs[dir]
+		if !ok {
+			cfg, err = readLayerConfig(dir)
+			if err != nil {
+				return err
+			}
+			cfgs[dir] = cfg
+			cfgDirs = append(cfgDirs, dir)
+		}
+		cfg.data, err = dotfile.RemoveFromConfig(cfg.data, name)
+		if err != nil {
+			return err
+		}
+		dfs = append(dfs, retrieved...)
+	}
+	if opts.DeleteSource {
+		if err := c.checkSharedSources(dfs); err != nil {
+			return err
+		}
+	}
+	if err := c.backupModified(modifiedDfs); err != nil {
+		return err
+	}
+
+	tx := newTransaction(c.debugger)
+	for _, df := range dfs {
+		c.debugger.Debugf("Forgetting dotfile %s", df.Name)
+		if opts.Restore {
+			backupPath, err := c.originalBackupPath(df)
+			if err != nil {
+				return c.rollback(tx, err)
+			}
+			if err := c.restoreDotfile(tx, df, backupPath); err != nil {
+				return c.rollback(tx, errors.Wrapf(err, "failed to restore %s", df.Name))
+			}
+		}
+		if opts.DeleteSource {
+			if err := c.deleteSource(tx, df); err != nil {
+				return c.rollback(tx, errors.Wrapf(err, "failed to delete source of %s", df.Name))
+			}
+		}
+	}
+	for _, name := range names {
+		if err := tx.remove(c.basePath(name)); err != nil {
+			return c.rollback(tx, errors.Wrapf(err, "failed to remove merge base of %s", name))
+		}
+	}
+	for _, dir := range cfgDirs {
+		cfg := cfgs[dir]
+		if err := tx.writeFile(cfg.path, cfg.data, cfg.perm); err != nil {
+			return c.rollback(tx, errors.Wrapf(err, "failed to update %s", cfg.path))
+		}
+	}
+	registry, err := c.reopenRegistry()
+	if err != nil {
+		return c.rollback(tx, err)
+	}
+
+	prevInfos := make(map[string]dotfileInfo)
+	for _, name := range names {
+		if info, ok := c.lf.Dotfiles[name]; ok {
+			prevInfos[name] = info
+			delete(c.lf.Dotfiles, name)
+		}
+	}
+	if err := c.writeLockfile(); err != nil {
+		for name, info := range prevInfos {
+			c.lf.Dotfiles[name] = info
+		}
+		return c.rollback(tx, errors.Wrap(err, "failed to save lockfile"))
+	}
+	c.registry = registry
+	return nil
+}
+
+// layerConfig is the `dot.yml` of a registry layer that is being edited.
+type layerConfig struct {
+	path string
+	perm fs.FileMode
+	data []byte
+}
+
+// readLayerConfig reads the `dot.yml` of the registry layer at dir.
+func readLayerConfig(dir string) (*layerConfig, error) {
+	cfgPath := filepath.Join(dir, dotfile.ConfigFile)
+	info, err := os.Stat(cfgPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get info of %s", cfgPath)
+	}
+	data, err := os.ReadFile(cfgPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", cfgPath)
+	}
+	return &layerConfig{path: cfgPath, perm: info.Mode().Perm(), data: data}, nil
+}
+
+// checkSharedSources makes sure none of the sources of dfs are used by a dotfile that is not in dfs,
+// since deleting them would break that dotfile.
+func (c *Client) checkSharedSources(dfs []dotfile.Dotfile) error {
+	forgotten := make(map[string]bool)
+	for _, df := range dfs {
+		forgotten[df.Name] = true
+	}
+	all, err := c.registry.Dotfiles()
+	if err != nil {
+		return errors.Wrap(err, "failed to get dotfiles from registry")
+	}
+	used := make(map[string]string)
+	for _, other := range all {
+		if forgotten[other.Name] {
+			continue
+		}
+		for _, p := range other.SrcPaths() {
+			used[filepath.Join(c.layerDir(other), p)] = other.Name
+		}
+	}
+	for _, df := range dfs {
+		for _, p := range df.SrcPaths() {
+			if name, ok := used[filepath.Join(c.layerDir(df), p)]; ok {
+				return errors.Errorf("cannot delete source of %s since it is also used by %s", df.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// deleteSource removes the sources of df from the registry as part of tx, including alternative sources.
+// If a source is a directory, all the files in it are removed, including ignored files.
+// Any directories in the registry that are left empty are also removed.
+func (c *Client) deleteSource(tx *transaction, df dotfile.Dotfile) error {
+	for _, p := range df.SrcPaths() {
+		if err := deleteSourcePath(tx, c.layerDir(df), p, df.IsDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSourcePath removes the source at p, which is relative to the registry layer at root, as part of tx.
+func deleteSourcePath(tx *transaction, root, p string, isDir bool) error {
+	srcPath := filepath.Join(root, filepath.FromSlash(p))
+	if !isDir {
+		if err := tx.remove(srcPath); err != nil {
+			return err
+		}
+		return removeEmptyParents(tx, filepath.Dir(srcPath), root)
+	}
+	var paths []string
+	err := filepath.WalkDir(srcPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		paths = append(paths, p)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to read directory %s", srcPath)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if err := tx.remove(p); err != nil {
+			return err
+		}
+	}
+	if err := removeEmptyDirs(tx, srcPath); err != nil {
+		return err
+	}
+	return removeEmptyParents(tx, filepath.Dir(srcPath), root)
+}
+
+// removeEmptyParents removes dir and each of its parents while they are empty as part of tx,
+// stopping at root. root itself is never removed.
+func removeEmptyParents(tx *transaction, dir, root string) error {
+	root = filepath.Clean(root)
+	for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if err := tx.removeEmptyDir(dir); err != nil {
+			return err
+		}
+		if !tx.wasRemoved(dir) {
+			return nil
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil
+}
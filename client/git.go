@@ -0,0 +1,146 @@
+package client
+
+import (
+	"bytes"
+	stderrors "errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoRemote is returned when an operation requires the registry to be from a git remote, but it is a local directory.
+var ErrNoRemote = stderrors.New("registry is not from a git remote")
+
+// scpURLRegex matches the scp-like syntax git supports for ssh URLs, ex: git@github.com:me/dotfiles.git.
+var scpURLRegex = regexp.MustCompile(`^[\w.-]+@[\w.-]+:`)
+
+// isGitURL returns whether or not registry refers to a remote git repository instead of a local directory.
+func isGitURL(registry string) bool {
+	for _, scheme := range []string{"https://", "http://", "ssh://", "git://", "file://"} {
+		if strings.HasPrefix(registry, scheme) {
+			return true
+		}
+	}
+	return scpURLRegex.MatchString(registry)
+}
+
+// registryCachePath returns the directory that registries cloned from git are stored in.
+func (c *Client) registryCachePath() string {
+	return filepath.Join(c.configPath(), "registry")
+}
+
+// runGit runs git with args in dir and returns its output with surrounding whitespace removed.
+// If git fails, the error contains what it wrote to stderr.
+func runGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return "", errors.Wrapf(err, "git %s failed", args[0])
+		}
+		return "", errors.Errorf("git %s failed: %s", args[0], msg)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// cloneRegistry clones the git repository at url into the registry cache, replacing anything
+// that is already there. The repository is cloned into a temporary directory and loaded along with
+// layers first, so that the cache is left untouched if cloning fails or the registry is invalid.
+func (c *Client) cloneRegistry(url string, layers []string) error {
+	dir := c.registryCachePath()
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return errors.Wrapf(err, "failed to create directory %s", filepath.Dir(dir))
+	}
+	// Clone next to the cache so that relative paths in extends resolve the same way
+	cloneDir, err := os.MkdirTemp(filepath.Dir(dir), "registry-clone-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp directory to clone registry")
+	}
+	defer os.RemoveAll(cloneDir)
+
+	c.debugger.Debugf("Cloning registry from %s", url)
+	if _, err := runGit(cloneDir, "clone", "--quiet", url, "."); err != nil {
+		return errors.Wrapf(err, "failed to clone registry from %s", url)
+	}
+	if _, _, err := c.openRegistry(cloneDir, false, layers); err != nil {
+		return errors.Wrapf(err, "invalid registry cloned from %s", url)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrapf(err, "failed to remove previous registry %s", dir)
+	}
+	if err := os.Rename(cloneDir, dir); err != nil {
+		return errors.Wrapf(err, "failed to move cloned registry to %s", dir)
+	}
+	return nil
+}
+
+// headCommit returns the commit that the registry repository is currently on.
+func (c *Client) headCommit() (string, error) {
+	commit, err := runGit(c.lf.RegistryDir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get current commit of registry %s", c.lf.RegistryDir)
+	}
+	return commit, nil
+}
+
+// Remote returns the URL of the git repository the registry was cloned from,
+// or an empty string if the registry is a local directory.
+func (c *Client) Remote() string {
+	return c.lf.Remote
+}
+
+// Pull fetches the latest changes to the registry from its git remote and fast-forwards to them.
+// It returns whether or not there were any new changes. The changes are not applied,
+// Apply must be called afterwards to apply them. If the registry is not from a git remote,
+// ErrNoRemote is returned. If the registry can't be fast-forwarded, for example because it
+// has local commits, an error is returned and the registry is left unchanged.
+func (c *Client) Pull() (bool, error) {
+	unlock, err := c.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	if c.lf.Remote == "" {
+		return false, errors.Wrap(ErrNoRemote, c.lf.RegistryDir)
+	}
+	before, err := c.headCommit()
+	if err != nil {
+		return false, err
+	}
+	c.debugger.Debugf("Fetching registry changes from %s", c.lf.Remote)
+	if _, err := runGit(c.lf.RegistryDir, "fetch", "--quiet", "origin"); err != nil {
+		return false, errors.Wrapf(err, "failed to fetch registry from %s", c.lf.Remote)
+	}
+	if _, err := runGit(c.lf.RegistryDir, "merge", "--ff-only", "--quiet", "@{upstream}"); err != nil {
+		return false, errors.Wrap(err, "failed to fast-forward registry")
+	}
+	after, err := c.headCommit()
+	if err != nil {
+		return false, err
+	}
+	if after == before {
+		return false, nil
+	}
+	c.debugger.Debugf("Registry updated from %s to %s", before, after)
+	registry, err := c.reopenRegistry()
+	if err != nil {
+		// Go back to the previous commit so the registry is still usable. Use --keep so that
+		// uncommitted changes, ex: from Add or Capture, are never lost.
+		if _, resetErr := runGit(c.lf.RegistryDir, "reset", "--keep", "--quiet", before); resetErr != nil {
+			return false, errors.Wrapf(err, "failed to load updated registry, and failed to reset it to %s: %v", before, resetErr)
+		}
+		return false, errors.Wrapf(err, "failed to load updated registry, it was reset to %s", before)
+	}
+	c.registry = registry
+	c.tmplData = nil
+	return true, nil
+}
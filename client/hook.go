@@ -0,0 +1,91 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cszatmary/dot/dotfile"
+	"github.com/pkg/errors"
+)
+
+// Hook types, used to describe which hook is being run.
+const (
+	hookPreApply  = "pre_apply"
+	hookPostApply = "post_apply"
+)
+
+// runHooks runs each command in cmds in dir, the directory of a registry layer, with env added to the environment.
+// If the registry is an archive, the commands are run in the home directory instead.
+// owner describes who the hooks belong to and hookType is the type of hook, they are used in messages.
+// If a command fails, an error is returned and the remaining commands are not run,
+// unless ignoreErrors is true in which case the failure is reported to the hook output.
+func (c *Client) runHooks(owner, hookType, dir string, cmds dotfile.Commands, env []string, ignoreErrors bool) error {
+	for _, command := range cmds {
+		c.debugger.Debugf("Running %s %s hook: %s", owner, hookType, command)
+		cmd := shellCommand(command)
+		cmd.Dir = dir
+		if c.isArchiveLayer(dir) {
+			// Archives aren't extracted, so there is no registry directory
+			cmd.Dir = c.homeDir
+		}
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdout = c.hookOutput
+		cmd.Stderr = c.hookOutput
+		err := cmd.Run()
+		if err == nil {
+			continue
+		}
+		if !ignoreErrors {
+			return errors.Wrapf(err, "%s %s hook %q failed", owner, hookType, command)
+		}
+		fmt.Fprintf(c.hookOutput, "%s %s hook %q failed, ignoring: %v\n", owner, hookType, command, err)
+	}
+	return nil
+}
+
+// runDotfileHooks runs the hooks of the given type for the staged dotfile s.
+func (c *Client) runDotfileHooks(s stagedDotfile, hookType string, ignoreErrors bool) error {
+	df := s.check.df
+	cmds := df.Hooks.PreApply
+	if hookType == hookPostApply {
+		cmds = df.Hooks.PostApply
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	dir := c.layerDir(df)
+	src := filepath.Join(dir, filepath.FromSlash(df.SrcPath))
+	if c.isArchiveLayer(dir) {
+		src = df.SrcPath
+	}
+	env := []string{
+		"DOT_NAME=" + df.Name,
+		"DOT_SRC=" + src,
+		"DOT_DST=" + df.DstPath,
+		"DOT_ACTION=" + s.action.String(),
+	}
+	return c.runHooks(df.Name, hookType, dir, cmds, env, ignoreErrors)
+}
+
+// runRegistryHooks runs the registry hooks of the given type. names are the names of the dotfiles that changed.
+// If the registry is layered, the hooks of each layer are run in its directory from the lowest layer to the highest.
+func (c *Client) runRegistryHooks(hookType string, names []string, ignoreErrors bool) error {
+	layers := c.registry.Layers()
+	if layers == nil {
+		layers = []dotfile.Layer{{Name: c.lf.RegistryDir, Registry: c.registry}}
+	}
+	env := []string{"DOT_DOTFILES=" + strings.Join(names, " ")}
+	for _, l := range layers {
+		hooks := l.Registry.Hooks()
+		cmds := hooks.PreApply
+		if hookType == hookPostApply {
+			cmds = hooks.PostApply
+		}
+		if err := c.runHooks("registry", hookType, l.Name, cmds, env, ignoreErrors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
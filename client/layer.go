@@ -0,0 +1,121 @@
+package client
+
+import (
+	"path/filepath"
+
+	"github.com/cszatmary/dot/dotfile"
+	"github.com/pkg/errors"
+)
+
+// openRegistry loads the registry at path along with layers, which are the directories of registries
+// that are layered on top of it from lowest to highest. Any registry that another one extends is
+// loaded as a layer below it. If the registry has a single layer, a regular registry is returned,
+// otherwise a layered registry is returned where the name of each layer is its directory.
+// See openLayer for details on isArchive and the returned checksum.
+func (c *Client) openRegistry(path string, isArchive bool, layers []string) (*dotfile.Registry, string, error) {
+	base, archiveSum, err := openLayer(path, isArchive)
+	if err != nil {
+		return nil, "", err
+	}
+	if isArchive && base.Extends() != "" {
+		return nil, "", errors.Errorf("registry archive %s cannot extend another registry", path)
+	}
+
+	var resolved []dotfile.Layer
+	loaded := make(map[string]bool)
+	loading := make(map[string]bool)
+	var add func(dir string, registry *dotfile.Registry) error
+	add = func(dir string, registry *dotfile.Registry) error {
+		if loaded[dir] {
+			return nil
+		}
+		if loading[dir] {
+			return errors.Errorf("registry %s extends itself", dir)
+		}
+		loading[dir] = true
+		if extends := registry.Extends(); extends != "" {
+			extendsDir := expandTilde(extends, c.homeDir)
+			if !filepath.IsAbs(extendsDir) {
+				extendsDir = filepath.Join(dir, extendsDir)
+			}
+			extendsDir = filepath.Clean(extendsDir)
+			if !loaded[extendsDir] {
+				c.debugger.Debugf("Registry %s extends %s", dir, extendsDir)
+				extended, _, err := openLayer(extendsDir, false)
+				if err != nil {
+					return errors.Wrapf(err, "failed to load registry extended by %s", dir)
+				}
+				if err := add(extendsDir, extended); err != nil {
+					return err
+				}
+			}
+		}
+		loaded[dir] = true
+		resolved = append(resolved, dotfile.Layer{Name: dir, Registry: registry})
+		return nil
+	}
+	if err := add(path, base); err != nil {
+		return nil, "", err
+	}
+	for _, dir := range layers {
+		if loaded[dir] {
+			continue
+		}
+		registry, _, err := openLayer(dir, false)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := add(dir, registry); err != nil {
+			return nil, "", err
+		}
+	}
+	if len(resolved) == 1 {
+		return base, archiveSum, nil
+	}
+	registry, err := dotfile.NewLayeredRegistry(resolved...)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to load layered registry")
+	}
+	return registry, archiveSum, nil
+}
+
+// reopenRegistry loads the registry again using the lockfile, ex: after the registry was modified.
+func (c *Client) reopenRegistry() (*dotfile.Registry, error) {
+	registry, _, err := c.openRegistry(c.lf.RegistryDir, c.lf.Archive != "", c.lf.Layers)
+	return registry, err
+}
+
+// layerDir returns the directory of the registry layer that df comes from.
+// If the registry is not layered, it is the registry dir.
+func (c *Client) layerDir(df dotfile.Dotfile) string {
+	if df.Layer != "" {
+		return df.Layer
+	}
+	return c.lf.RegistryDir
+}
+
+// isArchiveLayer returns whether or not the registry layer at dir is an archive.
+func (c *Client) isArchiveLayer(dir string) bool {
+	return c.lf.Archive != "" && dir == c.lf.RegistryDir
+}
+
+// stringsEqual returns whether or not a and b contain the same strings in the same order.
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// topLayerDir returns the directory of the highest registry layer, which is where new dotfiles are added.
+func (c *Client) topLayerDir() string {
+	if len(c.lf.Layers) > 0 {
+		return c.lf.Layers[len(c.lf.Layers)-1]
+	}
+	return c.lf.RegistryDir
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	stderrors "errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLocked is returned when another dot process is running and has locked the dot config.
+var ErrLocked = stderrors.New("another dot process is running")
+
+// errLockHeld is returned by lockFile if the lock is held by another process.
+var errLockHeld = stderrors.New("lock is held by another process")
+
+// lockRetryInterval is how often to retry acquiring the lock while waiting for it.
+const lockRetryInterval = 50 * time.Millisecond
+
+// lockPath returns the path to the file used to prevent multiple dot processes
+// from modifying dotfiles at the same time.
+func (c *Client) lockPath() string {
+	return filepath.Join(c.configPath(), "lock")
+}
+
+// lock acquires an exclusive lock on the dot config so that no other dot process can modify
+// dotfiles, the lockfile, or backups until it is released by calling the returned function.
+// If the lock is held by another process, lock waits up to the lock timeout for it to be released
+// before returning ErrLocked.
+//
+// Once the lock is acquired, the lockfile is reloaded since another process may have changed it
+// after it was read by New.
+func (c *Client) lock() (func(), error) {
+	p := c.lockPath()
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create directory %s", filepath.Dir(p))
+	}
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open lock file %s", p)
+	}
+
+	deadline := time.Now().Add(c.lockTimeout)
+	for waited := false; ; waited = true {
+		err := lockFile(f)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errLockHeld) {
+			f.Close()
+			return nil, errors.Wrapf(err, "failed to lock %s", p)
+		}
+		if !time.Now().Before(deadline) {
+			f.Close()
+			if c.lockTimeout > 0 {
+				return nil, errors.Wrapf(ErrLocked, "timed out after %s waiting for lock %s", c.lockTimeout, p)
+			}
+			return nil, errors.Wrapf(ErrLocked, "lock %s is held", p)
+		}
+		if !waited {
+			c.debugger.Debugf("Waiting for another dot process to release lock %s", p)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+	c.debugger.Debugf("Acquired lock %s", p)
+
+	unlock := func() {
+		if err := unlockFile(f); err != nil {
+			c.debugger.Debugf("Failed to unlock %s: %v", p, err)
+		}
+		f.Close()
+	}
+	if err := c.reloadLockfile(); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// reloadLockfile reads the lockfile again, and the registry if the registry dir or layers changed.
+// If an error occurs, the client is left unchanged.
+func (c *Client) reloadLockfile() error {
+	prevLf := c.lf
+	c.lf = &lockfile{}
+	if err := c.readLockfile(true); err != nil {
+		c.lf = prevLf
+		return err
+	}
+	if !c.IsSetup() || (c.lf.RegistryDir == prevLf.RegistryDir && stringsEqual(c.lf.Layers, prevLf.Layers)) {
+		return nil
+	}
+	c.debugger.Debugf("Registry changed to %s by another dot process, reloading", c.lf.RegistryDir)
+	registry, archiveSum, err := c.openRegistry(c.lf.RegistryDir, c.lf.Archive != "", c.lf.Layers)
+	if err != nil {
+		c.lf = prevLf
+		return err
+	}
+	c.registry = registry
+	c.archiveSum = archiveSum
+	c.tmplData = nil
+	return nil
+}
+
+// writeFileAtomic writes data to the file at path by writing it to a temporary file in the
+// same directory and then renaming it to path. This guarantees that path contains either its
+// previous contents or data, even if dot is interrupted part way through.
+func writeFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", dir, err)
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file in %q: %w", dir, err)
+	}
+	tmp := f.Name()
+	// Make sure the temp file is cleaned up if anything fails, this is a no-op once it is renamed
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write file %q: %w", tmp, err)
+	}
+	// Make sure the data is on disk before renaming, otherwise a crash could leave path empty
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync file %q: %w", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close file %q: %w", tmp, err)
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		return fmt.Errorf("failed to set mode of %q: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to rename %q to %q: %w", tmp, path, err)
+	}
+	return syncDir(dir)
+}
@@ -0,0 +1,69 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package client_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cszatmary/dot/client"
+)
+
+func TestApplyLocked(t *testing.T) {
+	homeDir := t.TempDir()
+	dotClient, err := client.New(client.WithHomeDir(homeDir), client.WithLockTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = dotClient.Setup(client.SetupOptions{RegistryDir: "testdata/registry-1"})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	// Simulate another dot process holding the lock
+	f, err := os.OpenFile(filepath.Join(homeDir, ".config", "dot", "lock"), os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	noWaitClient, err := client.New(client.WithHomeDir(homeDir))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	err = noWaitClient.Apply(client.ApplyOptions{})
+	if !errors.Is(err, client.ErrLocked) {
+		t.Errorf("got error %v, want %v", err, client.ErrLocked)
+	}
+	if _, err := os.Stat(filepath.Join(homeDir, ".gitconfig")); !os.IsNotExist(err) {
+		t.Errorf("want .gitconfig to not exist, got %v", err)
+	}
+
+	// Release the lock after a bit, Apply should wait for it
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	}()
+	err = dotClient.Apply(client.ApplyOptions{})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	filesEqual(t, filepath.Join(homeDir, ".gitconfig"), "testdata/registry-1/git/gitconfig")
+
+	// The lockfile should be replaced atomically without leaving any temp files behind
+	matches, err := filepath.Glob(filepath.Join(homeDir, ".config", "dot", "*.tmp"))
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if len(matches) > 0 {
+		t.Errorf("want no temp files, got %v", matches)
+	}
+}
@@ -0,0 +1,208 @@
+package client
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLockfileVersion is returned when the lockfile was written by a newer version of dot
+// and therefore cannot be read.
+var ErrLockfileVersion = stderrors.New("unsupported lockfile version")
+
+// lockfileVersion is the current version of the lockfile schema.
+// It must be incremented whenever the schema changes and a migration must be added to lockfileMigrations.
+const lockfileVersion = 2
+
+// lockfileMigrations contains the migrations used to upgrade older lockfiles.
+// lockfileMigrations[i] upgrades a lockfile from version i to version i+1.
+// Migrations operate on the raw JSON since older lockfiles may not be compatible with the current types.
+var lockfileMigrations = []func(lf map[string]interface{}) error{
+	migrateLockfileV0,
+	migrateLockfileV1,
+}
+
+type lockfile struct {
+	// Version is the version of the lockfile schema. Lockfiles without a version are version 0.
+	Version     int                    `json:"version"`
+	RegistryDir string                 `json:"registryDir"`
+	Dotfiles    map[string]dotfileInfo `json:"dotfiles"`
+	// Profile is the profile that was chosen when dot was setup. If empty, all dotfiles are used.
+	Profile string `json:"profile,omitempty"`
+	// Remote is the URL of the git repository the registry was cloned from.
+	// It is empty if the registry is a local directory.
+	Remote string `json:"remote,omitempty"`
+	// Commit is the commit of the registry repository that was last applied.
+	// It is only set if Remote is set.
+	Commit string `json:"commit,omitempty"`
+	// Archive is the path or URL of the archive the registry was loaded from. If it is set,
+	// RegistryDir is the path to the archive file instead of a directory.
+	Archive string `json:"archive,omitempty"`
+	// ArchiveSum is the sha256 checksum of the archive that was last applied.
+	// It is used to detect when the archive changes.
+	ArchiveSum string `json:"archiveSum,omitempty"`
+	// Layers are the directories of registries that are layered on top of the registry, from lowest to highest.
+	Layers []string `json:"layers,omitempty"`
+}
+
+type dotfileInfo struct {
+	// stringified hash, used to determine if the file has been modified
+	// If the dotfile is a directory, it is a hash of all the hashes in Files.
+	DstHash string `json:"dstHash"`
+	// HashAlgo is the algorithm used to create DstHash and Files.
+	HashAlgo hashAlgo `json:"hashAlgo,omitempty"`
+	// Files contains the hash of each file if the dotfile is a directory.
+	// The keys are the paths of the files relative to the directory.
+	Files map[string]string `json:"files,omitempty"`
+	// DstPath is the path of the destination with '~' expanded. It is recorded so that
+	// the destination can be found if the dotfile is removed from the registry.
+	// It may be empty for dotfiles that were setup by older versions of dot.
+	DstPath string `json:"dstPath,omitempty"`
+	// Perm, Owner, and Group are the permissions and ownership that were set on the destination
+	// when it was last applied. They are used to detect when they are changed in the registry.
+	Perm  fs.FileMode `json:"perm,omitempty"`
+	Owner string      `json:"owner,omitempty"`
+	Group string      `json:"group,omitempty"`
+}
+
+// algo returns the hash algorithm used by info.
+func (info dotfileInfo) algo() hashAlgo {
+	// Should be set by migrateLockfileV0, but be safe since md5 was the only algorithm originally
+	if info.HashAlgo == "" {
+		return hashMD5
+	}
+	return info.HashAlgo
+}
+
+// hashAlgo is the algorithm used to hash dotfiles.
+type hashAlgo string
+
+const (
+	hashMD5    hashAlgo = "md5"
+	hashSHA256 hashAlgo = "sha256"
+	// defaultHashAlgo is the algorithm used for all new hashes. Hashes using
+	// other algorithms are migrated to it once the dotfile is verified to be unmodified.
+	defaultHashAlgo = hashSHA256
+)
+
+func (c *Client) lockfilePath() string {
+	return filepath.Join(c.configPath(), "dot.lock")
+}
+
+// readLockfile reads the lockfile into c.lf. If the lockfile does not exist, c.lf is left unchanged.
+// If the lockfile is from an older version, it is migrated to the current version. If save is true,
+// a copy of the original is saved and the migrated lockfile is written back in place. save must only
+// be true while the lock is held, otherwise another dot process could be writing the lockfile too.
+func (c *Client) readLockfile(save bool) error {
+	lfp := c.lockfilePath()
+	data, err := os.ReadFile(lfp)
+	if errors.Is(err, os.ErrNotExist) {
+		// No lockfile, dot has not been setup
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read lockfile %s", lfp)
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return errors.Wrapf(err, "failed to parse lockfile %s", lfp)
+	}
+	version := 0
+	if v, ok := raw["version"]; ok {
+		// JSON numbers are always decoded as float64
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int(f)) {
+			return errors.Errorf("lockfile %s has invalid version %v", lfp, v)
+		}
+		version = int(f)
+	}
+	if version > lockfileVersion {
+		return errors.Wrapf(
+			ErrLockfileVersion,
+			"lockfile %s has version %d which was written by a newer version of dot, the latest version supported is %d, please upgrade dot",
+			lfp, version, lockfileVersion,
+		)
+	}
+
+	migrated := version < lockfileVersion
+	original := data
+	if migrated {
+		c.debugger.Debugf("Migrating lockfile from version %d to %d", version, lockfileVersion)
+		for v := version; v < lockfileVersion; v++ {
+			if err := lockfileMigrations[v](raw); err != nil {
+				return errors.Wrapf(err, "failed to migrate lockfile %s from version %d to %d", lfp, v, v+1)
+			}
+		}
+		raw["version"] = lockfileVersion
+		data, err = json.Marshal(raw)
+		if err != nil {
+			return errors.Wrap(err, "failed to serialize migrated lockfile")
+		}
+	}
+
+	if err := json.Unmarshal(data, c.lf); err != nil {
+		return errors.Wrapf(err, "failed to parse lockfile %s", lfp)
+	}
+	if migrated && save {
+		// Keep the original in case anything goes wrong with the migration
+		backupPath := fmt.Sprintf("%s.v%d.bak", lfp, version)
+		c.debugger.Debugf("Saving migrated lockfile, original saved to %s", backupPath)
+		if err := os.WriteFile(backupPath, original, 0o644); err != nil {
+			return errors.Wrapf(err, "failed to save copy of lockfile to %s", backupPath)
+		}
+		if err := c.writeLockfile(); err != nil {
+			return errors.Wrap(err, "failed to save migrated lockfile")
+		}
+	}
+	return nil
+}
+
+// writeLockfile writes c.lf to the lockfile. The lockfile is replaced atomically
+// so it is never left partially written.
+func (c *Client) writeLockfile() error {
+	lfp := c.lockfilePath()
+	c.lf.Version = lockfileVersion
+	data, err := json.Marshal(c.lf)
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize lockfile")
+	}
+	if err := writeFileAtomic(lfp, append(data, '\n'), 0o644); err != nil {
+		return errors.Wrapf(err, "failed to write lockfile to %s", lfp)
+	}
+	return nil
+}
+
+// migrateLockfileV0 migrates a lockfile from version 0 to version 1.
+// Version 0 lockfiles did not always record the hash algorithm, in which case it was md5.
+func migrateLockfileV0(lf map[string]interface{}) error {
+	dotfiles, ok := lf["dotfiles"].(map[string]interface{})
+	if !ok {
+		// No dotfiles, nothing to migrate
+		return nil
+	}
+	for name, v := range dotfiles {
+		info, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid lockfile entry for dotfile %s", name)
+		}
+		if _, ok := info["hashAlgo"]; !ok {
+			info["hashAlgo"] = string(hashMD5)
+		}
+	}
+	return nil
+}
+
+// migrateLockfileV1 migrates a lockfile from version 1 to version 2.
+// Version 2 added registries loaded from archives, where RegistryDir is the path to the archive
+// file instead of a directory, and layered registries. Older versions of dot would silently treat
+// an archive as a directory and ignore the layers, so the version was bumped to stop them from
+// reading these lockfiles. Version 1 lockfiles never use either, so nothing needs to be changed.
+func migrateLockfileV1(lf map[string]interface{}) error {
+	return nil
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	stderrors "errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cszatmary/dot/dotfile"
+	"github.com/cszatmary/dot/internal/diff"
+	"github.com/pkg/errors"
+)
+
+// ErrMergeConflict is returned by Apply when merging a dotfile results in conflicts.
+var ErrMergeConflict = stderrors.New("merge conflict")
+
+// Labels used for conflict markers.
+const (
+	mergeLocalName    = "local"
+	mergeRegistryName = "registry"
+)
+
+// basesPath returns the dir where merge bases are stored. The merge base of a dotfile
+// is the content that was last applied, or the content when it was setup if it has
+// never been applied. It is used as the common ancestor when merging.
+func (c *Client) basesPath() string {
+	return filepath.Join(c.configPath(), "bases")
+}
+
+func (c *Client) basePath(name string) string {
+	return filepath.Join(c.basesPath(), name)
+}
+
+// saveSetupBase saves the destination of df as its merge base, since that is the
+// content the hash in the lockfile refers to when a dotfile is setup.
+// Nothing is saved if the destination is not a regular file.
+func (c *Client) saveSetupBase(df dotfile.Dotfile) error {
+	info, err := os.Lstat(df.DstPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get info of %s", df.DstPath)
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	data, err := os.ReadFile(df.DstPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", df.DstPath)
+	}
+	p := c.basePath(df.Name)
+	if err := writeFileAtomic(p, data, 0o644); err != nil {
+		return errors.Wrapf(err, "failed to save merge base of %s", df.Name)
+	}
+	return nil
+}
+
+// readBase reads the merge base of the dotfile in check. false is returned if there
+// is no merge base or if it does not match the hash in the lockfile, since that means
+// it is not what dot last applied.
+func (c *Client) readBase(check dotfileCheck) ([]byte, bool, error) {
+	p := c.basePath(check.df.Name)
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to read merge base %s", p)
+	}
+	if hashData(check.info.algo(), data) != check.info.DstHash {
+		c.debugger.Debugf("Merge base of %s is out of date, ignoring", check.df.Name)
+		return nil, false, nil
+	}
+	return data, true, nil
+}
+
+// planMerge determines the action for a dotfile that was manually modified when merging is enabled.
+// If the dotfile can be merged without conflicts, the merged content is set on pa.
+func (c *Client) planMerge(pa plannedAction) (plannedAction, error) {
+	check := pa.check
+	switch {
+	case !check.outdated:
+		pa.Type = ActionSkipUnchanged
+		pa.Reason = "destination was manually modified, but source has not changed"
+		return pa, nil
+	case check.df.IsSymlink() || check.dstIsSymlink:
+		pa.Type = ActionBlocked
+		pa.Reason = "symlinks cannot be merged"
+		return pa, nil
+	case check.df.IsDir:
+		pa.Type = ActionBlocked
+		pa.Reason = "directories cannot be merged"
+		return pa, nil
+	}
+
+	base, ok, err := c.readBase(check)
+	if err != nil {
+		return pa, err
+	}
+	if !ok {
+		pa.Type = ActionBlocked
+		pa.Reason = "no merge base, dotfile must be applied before it can be merged"
+		return pa, nil
+	}
+	local, err := os.ReadFile(check.df.DstPath)
+	if err != nil {
+		return pa, errors.Wrapf(err, "failed to read %s", check.df.DstPath)
+	}
+	src, _, err := c.readSource(check.df)
+	if err != nil {
+		return pa, errors.Wrapf(err, "failed to read dotfile %s", check.df.Name)
+	}
+
+	merged, conflicts := diff.Merge(
+		diff.Lines(string(base)),
+		diff.Lines(string(local)),
+		diff.Lines(string(src)),
+		mergeLocalName,
+		mergeRegistryName,
+	)
+	if conflicts > 0 {
+		pa.Type = ActionBlocked
+		pa.Reason = fmt.Sprintf("manual modifications conflict with source changes (%d conflicts)", conflicts)
+		pa.conflicts = conflicts
+		return pa, nil
+	}
+	pa.Type = ActionMerge
+	pa.Reason = "manual modifications will be merged with source changes"
+	pa.merged = []byte(strings.Join(merged, ""))
+	return pa, nil
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// orphanCheck contains the result of checking a dotfile that is in the lockfile
+// but is no longer in the registry.
+type orphanCheck struct {
+	name string
+	info dotfileInfo
+	// dstExists is whether or not the dotfile destination exists.
+	dstExists bool
+	// modified is whether or not the destination was changed since dot last wrote it.
+	// It is also true if the destination is unknown, since it can't be checked.
+	modified bool
+}
+
+// Orphans returns the names of dotfiles that are still managed by dot but are no longer in the registry.
+// These are dotfiles that were removed from `dot.yml` without using Forget. They can be removed
+// using Apply with the Prune option, or using Forget.
+func (c *Client) Orphans() ([]string, error) {
+	dfs, err := c.registry.Dotfiles()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get dotfiles from registry")
+	}
+	inRegistry := make(map[string]bool, len(dfs))
+	for _, df := range dfs {
+		inRegistry[df.Name] = true
+	}
+	var names []string
+	for name := range c.lf.Dotfiles {
+		if !inRegistry[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// checkOrphans checks each of the dotfiles returned by Orphans.
+func (c *Client) checkOrphans() ([]orphanCheck, error) {
+	names, err := c.Orphans()
+	if err != nil {
+		return nil, err
+	}
+	orphans := make([]orphanCheck, len(names))
+	for i, name := range names {
+		o, err := c.checkOrphan(name)
+		if err != nil {
+			return nil, err
+		}
+		orphans[i] = o
+	}
+	return orphans, nil
+}
+
+func (c *Client) checkOrphan(name string) (orphanCheck, error) {
+	info := c.lf.Dotfiles[name]
+	o := orphanCheck{name: name, info: info}
+	if info.DstPath == "" {
+		o.modified = true
+		return o, nil
+	}
+	fi, err := os.Lstat(info.DstPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return o, errors.Wrapf(err, "failed to get info of %s", info.DstPath)
+	}
+	o.dstExists = true
+
+	// Directories installed by copying have the hash of each file, anything else is a single hash
+	if info.Files == nil {
+		if fi.IsDir() {
+			o.modified = true
+			return o, nil
+		}
+		hash, _, err := hashDst(info.algo(), info.DstPath)
+		if err != nil {
+			return o, err
+		}
+		o.modified = hash != info.DstHash
+		return o, nil
+	}
+	if !fi.IsDir() {
+		o.modified = true
+		return o, nil
+	}
+	for rel, want := range info.Files {
+		hash, _, err := hashDst(info.algo(), filepath.Join(info.DstPath, filepath.FromSlash(rel)))
+		if err != nil {
+			return o, err
+		}
+		if hash != want {
+			o.modified = true
+			break
+		}
+	}
+	return o, nil
+}
+
+// pruneOrphan removes the destination of the orphaned dotfile in o as part of tx,
+// along with its merge base. o must not be modified.
+func (c *Client) pruneOrphan(tx *transaction, o orphanCheck) error {
+	if err := tx.remove(c.basePath(o.name)); err != nil {
+		return err
+	}
+	if !o.dstExists {
+		return nil
+	}
+	if o.info.Files == nil {
+		return tx.remove(o.info.DstPath)
+	}
+	// Only remove the files managed by dot, leave anything else in the directory alone
+	rels := make([]string, 0, len(o.info.Files))
+	for rel := range o.info.Files {
+		if err := tx.remove(filepath.Join(o.info.DstPath, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+		rels = append(rels, rel)
+	}
+	return removeManagedDirs(tx, o.info.DstPath, rels)
+}
@@ -0,0 +1,191 @@
+package client
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cszatmary/dot/dotfile"
+	"github.com/pkg/errors"
+)
+
+// dstAttrs are the permissions and ownership that the files of a dotfile destination should have.
+type dstAttrs struct {
+	// perm is the permissions to set. If it is 0, the permissions of the source are used.
+	perm fs.FileMode
+	// uid and gid are the owner to set. They are -1 if they should not be changed.
+	uid, gid int
+}
+
+// hasOwner returns whether or not the owner or group should be set.
+func (a dstAttrs) hasOwner() bool {
+	return a.uid != -1 || a.gid != -1
+}
+
+// dotfileAttrs returns the attributes that the destination of df should have.
+func dotfileAttrs(df dotfile.Dotfile) (dstAttrs, error) {
+	a := dstAttrs{perm: df.Perm, uid: -1, gid: -1}
+	if df.Owner == "" && df.Group == "" {
+		return a, nil
+	}
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		return a, errors.Errorf("%s: owner and group are not supported on %s", df.Name, runtime.GOOS)
+	}
+	var err error
+	if df.Owner != "" {
+		a.uid, err = lookupID(df.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return a, errors.Wrapf(err, "%s: unknown owner %s", df.Name, df.Owner)
+		}
+	}
+	if df.Group != "" {
+		a.gid, err = lookupID(df.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return a, errors.Wrapf(err, "%s: unknown group %s", df.Name, df.Group)
+		}
+	}
+	return a, nil
+}
+
+// lookupID converts s to a numeric ID. If s is not a number, it is looked up by name using lookup.
+func lookupID(s string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	idStr, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(idStr)
+}
+
+// checkAttrs sets the attrs, drift, and attrsChanged fields of check by comparing
+// the destination of the dotfile with the permissions and ownership it should have.
+func checkAttrs(check dotfileCheck) (dotfileCheck, error) {
+	df := check.df
+	var err error
+	check.attrs, err = dotfileAttrs(df)
+	if err != nil {
+		return check, err
+	}
+	check.attrsChanged = attrsChanged(df, check.info)
+	if df.IsSymlink() || !check.dstExists || check.dstIsSymlink {
+		return check, nil
+	}
+	if check.attrs.perm == 0 && !check.attrs.hasOwner() {
+		return check, nil
+	}
+	if !df.IsDir {
+		check.drift, err = attrsDrift(df.DstPath, check.attrs)
+		return check, err
+	}
+
+	info, err := os.Lstat(df.DstPath)
+	if err != nil {
+		return check, errors.Wrapf(err, "failed to get info of %s", df.DstPath)
+	}
+	if !info.IsDir() {
+		return check, nil
+	}
+	rels := make([]string, 0, len(check.srcFiles))
+	for rel := range check.srcFiles {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	var drifts []string
+	for _, rel := range rels {
+		drift, err := attrsDrift(filepath.Join(df.DstPath, filepath.FromSlash(rel)), check.attrs)
+		if err != nil {
+			return check, err
+		}
+		if drift != "" {
+			drifts = append(drifts, rel+" "+drift)
+		}
+	}
+	check.drift = strings.Join(drifts, "; ")
+	return check, nil
+}
+
+// attrsDrift checks whether the file at path has the attributes in a. If it does not,
+// a description of the difference is returned, otherwise an empty string is returned.
+// Files that do not exist or are not regular files are ignored since they are already
+// considered modified.
+func attrsDrift(path string, a dstAttrs) (string, error) {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get info of %s", path)
+	}
+	if !info.Mode().IsRegular() {
+		return "", nil
+	}
+	var diffs []string
+	if a.perm != 0 && info.Mode().Perm() != a.perm {
+		diffs = append(diffs, fmt.Sprintf("mode is %#o instead of %#o", uint32(info.Mode().Perm()), uint32(a.perm)))
+	}
+	if uid, gid, ok := fileOwner(info); ok {
+		if a.uid != -1 && uid != a.uid {
+			diffs = append(diffs, fmt.Sprintf("owner is %d instead of %d", uid, a.uid))
+		}
+		if a.gid != -1 && gid != a.gid {
+			diffs = append(diffs, fmt.Sprintf("group is %d instead of %d", gid, a.gid))
+		}
+	}
+	return strings.Join(diffs, ", "), nil
+}
+
+// driftReason returns a description of why the permissions or ownership of the destination
+// in check need to be updated. It returns an empty string if they do not.
+func driftReason(check dotfileCheck) string {
+	switch {
+	case check.drift != "" && check.attrsChanged:
+		return "permissions changed in the registry: " + check.drift
+	case check.drift != "":
+		return "permissions were manually changed: " + check.drift
+	case check.attrsChanged:
+		return "permissions changed in the registry"
+	default:
+		return ""
+	}
+}
+
+// setOwner sets the owner in a on the file at path as part of tx, if there is one.
+// Permissions are set when the file is written.
+func (a dstAttrs) setOwner(tx *transaction, path string) error {
+	if !a.hasOwner() {
+		return nil
+	}
+	return tx.chown(path, a.uid, a.gid)
+}
+
+// attrsChanged returns whether the attributes of df are different from the ones
+// that were recorded in the lockfile when it was last applied.
+func attrsChanged(df dotfile.Dotfile, info dotfileInfo) bool {
+	return df.Perm != info.Perm || df.Owner != info.Owner || df.Group != info.Group
+}
+
+// newDotfileInfo returns the lockfile info for df without any hashes. It records the permissions
+// and ownership of df so that attrsChanged only reports changes made to them afterwards.
+func newDotfileInfo(df dotfile.Dotfile) dotfileInfo {
+	return dotfileInfo{HashAlgo: defaultHashAlgo, DstPath: df.DstPath, Perm: df.Perm, Owner: df.Owner, Group: df.Group}
+}
@@ -0,0 +1,216 @@
+package client
+
+import "github.com/pkg/errors"
+
+// ActionType is the type of action that will be taken when applying a dotfile.
+type ActionType int
+
+const (
+	// ActionCreate means the dotfile destination does not exist and will be created.
+	ActionCreate ActionType = iota
+	// ActionOverwrite means the dotfile destination will be overwritten with the source.
+	ActionOverwrite
+	// ActionSkipUnchanged means the dotfile is up to date and nothing will be done.
+	ActionSkipUnchanged
+	// ActionBlocked means the dotfile cannot be applied, for example
+	// because it was manually modified. Apply will fail if any actions are blocked.
+	ActionBlocked
+	// ActionSkipUnsupported means the dotfile does not support the current machine and will be skipped.
+	ActionSkipUnsupported
+	// ActionMerge means the dotfile was manually modified and the modifications
+	// will be merged with the changes to the source.
+	ActionMerge
+	// ActionOrphaned means the dotfile is no longer in the registry, but is still managed
+	// by dot. It will be left alone unless pruning is enabled.
+	ActionOrphaned
+	// ActionPrune means the dotfile is no longer in the registry and its destination will be removed.
+	ActionPrune
+)
+
+func (a ActionType) String() string {
+	switch a {
+	case ActionCreate:
+		return "create"
+	case ActionOverwrite:
+		return "overwrite"
+	case ActionSkipUnchanged:
+		return "skip"
+	case ActionBlocked:
+		return "blocked"
+	case ActionSkipUnsupported:
+		return "unsupported"
+	case ActionMerge:
+		return "merge"
+	case ActionOrphaned:
+		return "orphaned"
+	case ActionPrune:
+		return "prune"
+	default:
+		return "unknown"
+	}
+}
+
+// Action describes what will be done to a dotfile when it is applied.
+type Action struct {
+	// Name is the name of the dotfile.
+	Name string
+	// DstPath is the path to the dotfile destination with '~' expanded.
+	DstPath string
+	Type    ActionType
+	// Reason is a human readable explanation of why the action will be taken.
+	Reason string
+}
+
+// ApplyOptions configures how Apply and Plan handle dotfiles.
+type ApplyOptions struct {
+	// Force applies dotfiles even if they were manually modified, overwriting the modifications.
+	Force bool
+	// Merge performs a three-way merge of manual modifications with the changes to the source,
+	// using the content dot last applied as the base. Force and Merge cannot both be set.
+	Merge bool
+	// Prune removes dotfiles that are no longer in the registry. Their destinations are
+	// removed unless they were manually modified, in which case they are left alone.
+	// Pruning only happens if all dotfiles are applied, i.e. no names are provided.
+	Prune bool
+	// IgnoreHookErrors continues applying dotfiles if a hook fails instead of rolling back all changes.
+	IgnoreHookErrors bool
+}
+
+// validate returns an error if opts contains options that cannot be used together.
+func (opts ApplyOptions) validate() error {
+	if opts.Force && opts.Merge {
+		return errors.New("force and merge cannot both be enabled")
+	}
+	return nil
+}
+
+// plannedAction is an Action along with the check that was used to determine it.
+type plannedAction struct {
+	Action
+	check dotfileCheck
+	// merged is the merged content if the action is ActionMerge.
+	merged []byte
+	// conflicts is the number of conflicts if merging failed.
+	conflicts int
+	// orphan is the check of the dotfile if it is no longer in the registry.
+	orphan orphanCheck
+}
+
+// Plan returns the list of actions that Apply would take with the same arguments.
+// Plan does not modify any files or the lockfile.
+func (c *Client) Plan(opts ApplyOptions, names ...string) ([]Action, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	planned, err := c.plan(opts, names...)
+	if err != nil {
+		return nil, err
+	}
+	actions := make([]Action, len(planned))
+	for i, pa := range planned {
+		actions[i] = pa.Action
+	}
+	return actions, nil
+}
+
+func (c *Client) plan(opts ApplyOptions, names ...string) ([]plannedAction, error) {
+	dfs, err := c.dotfiles(names...)
+	if err != nil {
+		return nil, err
+	}
+
+	planned := make([]plannedAction, len(dfs))
+	for i, df := range dfs {
+		pa := plannedAction{Action: Action{Name: df.Name, DstPath: expandTilde(df.DstPath, c.homeDir)}}
+		reason, err := c.checkPlatform(df)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			pa.Type = ActionSkipUnsupported
+			pa.Reason = reason
+			planned[i] = pa
+			continue
+		}
+
+		check, err := c.checkDotfile(df)
+		if err != nil {
+			return nil, err
+		}
+		pa.check = check
+		switch {
+		case !check.setup:
+			pa.Type = ActionBlocked
+			pa.Reason = "dotfile has not been setup"
+		case check.modified && opts.Merge:
+			pa, err = c.planMerge(pa)
+			if err != nil {
+				return nil, err
+			}
+		case check.modified && !opts.Force:
+			pa.Type = ActionBlocked
+			pa.Reason = modifiedReason(check)
+		case !check.dstExists:
+			pa.Type = ActionCreate
+			pa.Reason = "destination does not exist"
+		case check.modified:
+			pa.Type = ActionOverwrite
+			pa.Reason = "destination was manually modified, but force mode is enabled"
+		case check.outdated:
+			pa.Type = ActionOverwrite
+			pa.Reason = "source has changed"
+		case driftReason(check) != "":
+			pa.Type = ActionOverwrite
+			pa.Reason = driftReason(check)
+		case opts.Force:
+			pa.Type = ActionOverwrite
+			pa.Reason = "force mode is enabled"
+		default:
+			pa.Type = ActionSkipUnchanged
+			pa.Reason = "destination is up to date"
+		}
+		planned[i] = pa
+	}
+	if len(names) > 0 {
+		return planned, nil
+	}
+
+	orphans, err := c.checkOrphans()
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range orphans {
+		pa := plannedAction{Action: Action{Name: o.name, DstPath: o.info.DstPath}, orphan: o}
+		switch {
+		case o.info.DstPath == "":
+			pa.Type = ActionOrphaned
+			pa.Reason = "dotfile was removed from the registry, but its destination is unknown"
+		case o.modified:
+			pa.Type = ActionOrphaned
+			pa.Reason = "dotfile was removed from the registry, but its destination was manually modified"
+		case !opts.Prune:
+			pa.Type = ActionOrphaned
+			pa.Reason = "dotfile was removed from the registry"
+		case !o.dstExists:
+			pa.Type = ActionPrune
+			pa.Reason = "dotfile was removed from the registry and its destination does not exist"
+		default:
+			pa.Type = ActionPrune
+			pa.Reason = "dotfile was removed from the registry"
+		}
+		planned = append(planned, pa)
+	}
+	return planned, nil
+}
+
+// modifiedReason returns a description of how the destination in check was modified.
+func modifiedReason(check dotfileCheck) string {
+	switch {
+	case check.df.IsSymlink() && !check.dstIsSymlink:
+		return "destination symlink was replaced by a regular file"
+	case !check.df.IsSymlink() && check.dstIsSymlink:
+		return "destination was replaced by a symlink"
+	default:
+		return "destination was manually modified"
+	}
+}
@@ -0,0 +1,185 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/cszatmary/dot/dotfile"
+	"github.com/pkg/errors"
+)
+
+// osReleasePaths are the paths to check for the os-release file, in order.
+// See https://www.freedesktop.org/software/systemd/man/os-release.html.
+var osReleasePaths = []string{"/etc/os-release", "/usr/lib/os-release"}
+
+// platform contains information about the current machine that is used
+// to determine which dotfiles can be used on it.
+type platform struct {
+	hostname string
+	// distros contains the ID and ID_LIKE values from os-release.
+	// It is empty if the OS is not Linux or os-release does not exist.
+	distros []string
+}
+
+// platform returns information about the current machine. It is only
+// computed the first time it is needed.
+func (c *Client) platform() (*platform, error) {
+	if c.plat != nil {
+		return c.plat, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get hostname")
+	}
+	p := &platform{hostname: hostname}
+	if runtime.GOOS == "linux" {
+		p.distros, err = readDistros()
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.plat = p
+	return p, nil
+}
+
+// checkPlatform checks whether df can be used on the current machine by evaluating its OS list,
+// its alternative sources, and its When conditions. If it can't, a human readable reason is
+// returned, otherwise the returned reason is empty. This is the only place conditions are
+// evaluated so that all operations skip the same dotfiles.
+func (c *Client) checkPlatform(df dotfile.Dotfile) (string, error) {
+	if !supportsOS(df) {
+		return fmt.Sprintf("not supported on %s", runtime.GOOS), nil
+	}
+	if df.SrcPath == "" {
+		// The registry chooses the source, so it is empty if none of the alternatives apply
+		return "none of the alternative sources are for this machine", nil
+	}
+	when := df.When
+	if len(when.Arch) > 0 && !contains(when.Arch, runtime.GOARCH) {
+		return fmt.Sprintf("not supported on %s architecture", runtime.GOARCH), nil
+	}
+	if len(when.Hostname) > 0 || len(when.Distro) > 0 {
+		p, err := c.platform()
+		if err != nil {
+			return "", err
+		}
+		if len(when.Hostname) > 0 && !matchesHostname(when.Hostname, p.hostname) {
+			return fmt.Sprintf("hostname %s does not match %s", p.hostname, strings.Join(when.Hostname, ", ")), nil
+		}
+		if len(when.Distro) > 0 && !containsAny(when.Distro, p.distros) {
+			return fmt.Sprintf("distribution is not one of %s", strings.Join(when.Distro, ", ")), nil
+		}
+	}
+	if len(when.Env) > 0 && !anyEnvSet(when.Env) {
+		return fmt.Sprintf("none of the environment variables %s are set", strings.Join(when.Env, ", ")), nil
+	}
+	if len(when.Command) > 0 && !anyCommandExists(when.Command) {
+		return fmt.Sprintf("none of the commands %s were found in PATH", strings.Join(when.Command, ", ")), nil
+	}
+	return "", nil
+}
+
+// supportsOS checks whether the dotfile supports the current OS.
+func supportsOS(df dotfile.Dotfile) bool {
+	// No OSes defined means all are supported
+	if len(df.OS) == 0 {
+		return true
+	}
+	currentOS := runtime.GOOS
+	for _, os := range df.OS {
+		if os == currentOS {
+			return true
+		}
+		// macOS is supported as an alias for darwin
+		if os == "macOS" && currentOS == "darwin" {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(values, vs []string) bool {
+	for _, v := range vs {
+		if contains(values, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesHostname(patterns []string, hostname string) bool {
+	for _, pattern := range patterns {
+		// Patterns are validated by the registry
+		if ok, _ := path.Match(pattern, hostname); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func anyEnvSet(names []string) bool {
+	for _, name := range names {
+		if _, ok := os.LookupEnv(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func anyCommandExists(commands []string) bool {
+	for _, command := range commands {
+		if _, err := exec.LookPath(command); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// readDistros returns the ID and ID_LIKE values from the first os-release file that exists.
+func readDistros() ([]string, error) {
+	for _, p := range osReleasePaths {
+		f, err := os.Open(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open %s", p)
+		}
+		defer f.Close()
+
+		var distros []string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			i := strings.Index(line, "=")
+			if i < 0 {
+				continue
+			}
+			key := line[:i]
+			if key != "ID" && key != "ID_LIKE" {
+				continue
+			}
+			value := strings.Trim(line[i+1:], `"'`)
+			distros = append(distros, strings.Fields(value)...)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", p)
+		}
+		return distros, nil
+	}
+	return nil, nil
+}
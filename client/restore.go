@@ -0,0 +1,313 @@
+package client
+
+import (
+	stderrors "errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/cszatmary/dot/dotfile"
+	"github.com/pkg/errors"
+)
+
+// ErrModified is returned when a dotfile cannot be restored because it was manually modified.
+var ErrModified = stderrors.New("dotfile was manually modified")
+
+// RestoreOptions is used to configure the behaviour of Restore and Uninstall.
+type RestoreOptions struct {
+	// Force restores dotfiles even if they were manually modified since they were last applied.
+	// The modifications are lost.
+	Force bool
+}
+
+// Restore undoes the changes made by dot to the given dotfiles by restoring the backups
+// that were made when they were setup. If a dotfile's destination did not exist before
+// it was setup, the destination is deleted instead. The dotfiles are then removed from
+// the lockfile so they are no longer managed by dot.
+//
+// If no names are provided, all dotfiles that have been setup will be restored, except for
+// dotfiles that were removed from the registry. If a dotfile was manually modified, ErrModified
+// is returned unless opts.Force is true, since restoring it would lose the modifications.
+// Like Apply, Restore is atomic. If any dotfile fails to be restored, all changes are rolled back.
+func (c *Client) Restore(opts RestoreOptions, names ...string) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return c.restore(opts, names...)
+}
+
+func (c *Client) restore(opts RestoreOptions, names ...string) error {
+	if len(names) == 0 {
+		orphans, err := c.Orphans()
+		if err != nil {
+			return err
+		}
+		isOrphan := make(map[string]bool, len(orphans))
+		for _, name := range orphans {
+			isOrphan[name] = true
+		}
+		for name := range c.lf.Dotfiles {
+			// Orphans can't be restored since they are no longer in the registry, leave them in place
+			if isOrphan[name] {
+				c.debugger.Debugf("Skipping %s since it is no longer in the registry", name)
+				continue
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	var dfs, modifiedDfs []dotfile.Dotfile
+	for _, name := range names {
+		if _, ok := c.lf.Dotfiles[name]; !ok {
+			return errors.Wrap(ErrNotSetup, name)
+		}
+		retrieved, err := c.registry.Dotfiles(name)
+		if err != nil {
+			return errors.Wrap(err, "failed to get dotfiles from registry")
+		}
+		modified, err := c.checkRestorable(retrieved[0], opts.Force)
+		if err != nil {
+			return err
+		}
+		if modified {
+			modifiedDfs = append(modifiedDfs, retrieved[0])
+		}
+		dfs = append(dfs, retrieved...)
+	}
+	if err := c.backupModified(modifiedDfs); err != nil {
+		return err
+	}
+
+	tx := newTransaction(c.debugger)
+	for _, df := range dfs {
+		c.debugger.Debugf("Restoring dotfile %s", df.Name)
+		backupPath, err := c.originalBackupPath(df)
+		if err != nil {
+			return c.rollback(tx, err)
+		}
+		if err := c.restoreDotfile(tx, df, backupPath); err != nil {
+			return c.rollback(tx, errors.Wrapf(err, "failed to restore %s", df.Name))
+		}
+		// The merge base is no longer needed since dot no longer manages the dotfile
+		if err := tx.remove(c.basePath(df.Name)); err != nil {
+			return c.rollback(tx, errors.Wrapf(err, "failed to remove merge base of %s", df.Name))
+		}
+	}
+
+	prevInfos := make(map[string]dotfileInfo)
+	for _, df := range dfs {
+		prevInfos[df.Name] = c.lf.Dotfiles[df.Name]
+		delete(c.lf.Dotfiles, df.Name)
+	}
+	if err := c.writeLockfile(); err != nil {
+		for name, info := range prevInfos {
+			c.lf.Dotfiles[name] = info
+		}
+		return c.rollback(tx, errors.Wrap(err, "failed to save lockfile"))
+	}
+	return nil
+}
+
+// Uninstall restores all dotfiles and then removes the lockfile, all backups, and the registry
+// if it was cloned or downloaded by dot, so that dot no longer manages any dotfiles.
+// opts is used like it is by Restore.
+func (c *Client) Uninstall(opts RestoreOptions) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := c.restore(opts); err != nil {
+		return err
+	}
+	lfp := c.lockfilePath()
+	if err := os.Remove(lfp); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove lockfile %s", lfp)
+	}
+	paths := []string{c.backupsPath(), c.basesPath()}
+	if c.lf.Remote != "" {
+		paths = append(paths, c.registryCachePath())
+	}
+	if isHTTPURL(c.lf.Archive) {
+		paths = append(paths, c.registryArchivePath(c.lf.Archive))
+	}
+	// The lock file is left in place since removing it would allow another
+	// process that is waiting for it to hold the lock at the same time as a new one
+	for _, p := range paths {
+		if err := os.RemoveAll(p); err != nil {
+			return errors.Wrapf(err, "failed to remove %s", p)
+		}
+	}
+	c.lf = &lockfile{}
+	c.registry = nil
+	return nil
+}
+
+// checkRestorable returns whether or not df was manually modified since it was last applied.
+// If it was, ErrModified is returned unless force is true, since restoring df would lose the modifications.
+func (c *Client) checkRestorable(df dotfile.Dotfile, force bool) (bool, error) {
+	check, err := c.checkDotfile(df)
+	if err != nil {
+		return false, err
+	}
+	if check.modified && !force {
+		return true, errors.Wrapf(ErrModified, "cannot restore %s, use force to restore it anyway", df.Name)
+	}
+	return check.modified, nil
+}
+
+// backupModified backs up each of dfs, which are modified dotfiles that are about to be restored
+// in force mode, so that the modifications are not lost.
+func (c *Client) backupModified(dfs []dotfile.Dotfile) error {
+	if len(dfs) == 0 {
+		return nil
+	}
+	idx, err := c.readBackupIndex()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(dfs))
+	for _, df := range dfs {
+		if err := c.backupCurrent(idx, df, BackupReasonForceRestore); err != nil {
+			return errors.Wrapf(err, "failed to backup %s", df.Name)
+		}
+		names = append(names, df.Name)
+	}
+	return c.saveBackupIndex(idx, names...)
+}
+
+// restoreDotfile removes the files installed by dot for df and then restores the backup at backupPath.
+// If backupPath is empty, the files are only removed.
+func (c *Client) restoreDotfile(tx *transaction, df dotfile.Dotfile, backupPath string) error {
+	dst := expandTilde(df.DstPath, c.homeDir)
+	if df.IsDir && !df.IsSymlink() {
+		// Only remove the files managed by dot, leave anything else in the directory alone
+		files := c.lf.Dotfiles[df.Name].Files
+		rels := make([]string, 0, len(files))
+		for rel := range files {
+			if err := tx.remove(filepath.Join(dst, filepath.FromSlash(rel))); err != nil {
+				return err
+			}
+			rels = append(rels, rel)
+		}
+		if err := removeManagedDirs(tx, dst, rels); err != nil {
+			return err
+		}
+		// If dst was replaced with a file it should be removed too
+		if info, err := os.Lstat(dst); err == nil && !info.IsDir() {
+			if err := tx.remove(dst); err != nil {
+				return err
+			}
+		}
+	} else if err := tx.remove(dst); err != nil {
+		return err
+	}
+
+	if backupPath == "" {
+		c.debugger.Debugf("No backup for %s, %s did not exist before setup", df.Name, dst)
+		return nil
+	}
+	info, err := os.Lstat(backupPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get info of backup %s", backupPath)
+	}
+	if !info.IsDir() {
+		return restoreFile(tx, backupPath, dst)
+	}
+	return filepath.WalkDir(backupPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(backupPath, p)
+		if err != nil {
+			return err
+		}
+		return restoreFile(tx, p, filepath.Join(dst, rel))
+	})
+}
+
+// restoreFile restores the backup file at src to dst as part of tx.
+// src may be a regular file or a symlink.
+func restoreFile(tx *transaction, src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get info of %s", src)
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read symlink %s", src)
+		}
+		return tx.symlink(target, dst)
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read backup %s", src)
+	}
+	return tx.writeFile(dst, data, info.Mode().Perm())
+}
+
+// removeManagedDirs removes dst and the directories within it that contained the files at rels,
+// which are relative to dst, if they are empty now that the files were removed. It is done as part
+// of tx so the directories are recreated on rollback. Other directories, such as empty directories
+// created by the user, are left alone.
+func removeManagedDirs(tx *transaction, dst string, rels []string) error {
+	if err := removeParentDirs(tx, dst, rels); err != nil {
+		return err
+	}
+	return tx.removeEmptyDir(dst)
+}
+
+// removeParentDirs is like removeManagedDirs but leaves dst in place.
+func removeParentDirs(tx *transaction, dst string, rels []string) error {
+	dirSet := make(map[string]bool)
+	for _, rel := range rels {
+		for d := path.Dir(rel); d != "."; d = path.Dir(d) {
+			dirSet[filepath.Join(dst, filepath.FromSlash(d))] = true
+		}
+	}
+	dirs := make([]string, 0, len(dirSet))
+	for d := range dirSet {
+		dirs = append(dirs, d)
+	}
+	// Sort in reverse so that directories are removed before their parents
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		if err := tx.removeEmptyDir(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeEmptyDirs removes root and any directories within it that are empty after their empty
+// subdirectories have been removed. It is done as part of tx so the directories are recreated on
+// rollback. It is not an error if root does not exist.
+func removeEmptyDirs(tx *transaction, root string) error {
+	info, err := os.Lstat(root)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && !info.IsDir()) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to get info of %s", root)
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read directory %s", root)
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if err := removeEmptyDirs(tx, filepath.Join(root, e.Name())); err != nil {
+			return err
+		}
+	}
+	return tx.removeEmptyDir(root)
+}
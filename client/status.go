@@ -0,0 +1,138 @@
+package client
+
+import (
+	"github.com/cszatmary/dot/dotfile"
+)
+
+// State represents the state of a dotfile managed by dot.
+type State int
+
+const (
+	// StateClean means the dotfile destination is up to date with the source.
+	StateClean State = iota
+	// StateModified means the dotfile destination was manually modified.
+	StateModified
+	// StateOutdated means the dotfile source has changed and needs to be applied.
+	StateOutdated
+	// StateDiverged means both the dotfile source and destination have changed.
+	StateDiverged
+	// StateMissing means the dotfile destination does not exist.
+	StateMissing
+	// StateNotSetup means the dotfile has not been setup to be managed by dot.
+	StateNotSetup
+	// StateUnsupported means the dotfile does not support the current machine,
+	// either because of its OS or because its conditions are not met.
+	StateUnsupported
+	// StateOrphaned means the dotfile was removed from the registry, but is still managed by dot.
+	StateOrphaned
+	// StateDrifted means the dotfile destination is up to date with the source, but its
+	// permissions or ownership are not what the registry specifies.
+	StateDrifted
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClean:
+		return "clean"
+	case StateModified:
+		return "modified"
+	case StateOutdated:
+		return "outdated"
+	case StateDiverged:
+		return "diverged"
+	case StateMissing:
+		return "missing"
+	case StateNotSetup:
+		return "not setup"
+	case StateUnsupported:
+		return "unsupported"
+	case StateOrphaned:
+		return "orphaned"
+	case StateDrifted:
+		return "drifted"
+	default:
+		return "unknown"
+	}
+}
+
+// DotfileStatus describes the state of a single dotfile.
+type DotfileStatus struct {
+	// Name is the name of the dotfile.
+	Name string
+	// DstPath is the path to the dotfile destination with '~' expanded.
+	DstPath string
+	State   State
+	// Reason is a human readable explanation of why the dotfile is unsupported
+	// or has drifted. It is empty for other states.
+	Reason string
+	// Layer is the directory of the registry layer the dotfile comes from.
+	// It is empty if the registry is not layered or the dotfile is orphaned.
+	Layer string
+}
+
+// Status returns the state of each dotfile in the registry.
+// Optionally, a list of dotfile names can be provided to only check specific dotfiles.
+// If no names are provided, all dotfiles will be checked, including dotfiles that were removed
+// from the registry but are still managed by dot.
+func (c *Client) Status(names ...string) ([]DotfileStatus, error) {
+	dfs, err := c.dotfiles(names...)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]DotfileStatus, len(dfs))
+	for i, df := range dfs {
+		s, err := c.dotfileStatus(df)
+		if err != nil {
+			return nil, err
+		}
+		statuses[i] = s
+	}
+	if len(names) > 0 {
+		return statuses, nil
+	}
+	orphans, err := c.Orphans()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range orphans {
+		statuses = append(statuses, DotfileStatus{Name: name, DstPath: c.lf.Dotfiles[name].DstPath, State: StateOrphaned})
+	}
+	return statuses, nil
+}
+
+func (c *Client) dotfileStatus(df dotfile.Dotfile) (DotfileStatus, error) {
+	s := DotfileStatus{Name: df.Name, DstPath: expandTilde(df.DstPath, c.homeDir), Layer: df.Layer}
+	reason, err := c.checkPlatform(df)
+	if err != nil {
+		return s, err
+	}
+	if reason != "" {
+		s.State = StateUnsupported
+		s.Reason = reason
+		return s, nil
+	}
+
+	check, err := c.checkDotfile(df)
+	if err != nil {
+		return s, err
+	}
+	switch {
+	case !check.setup:
+		s.State = StateNotSetup
+	case !check.dstExists:
+		s.State = StateMissing
+	case check.modified && check.outdated:
+		s.State = StateDiverged
+	case check.modified:
+		s.State = StateModified
+	case check.outdated:
+		s.State = StateOutdated
+	case driftReason(check) != "":
+		s.State = StateDrifted
+		s.Reason = driftReason(check)
+	default:
+		s.State = StateClean
+	}
+	return s, nil
+}
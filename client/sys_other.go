@@ -0,0 +1,35 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package client
+
+import (
+	"io/fs"
+	"os"
+	"os/exec"
+)
+
+// lockFile does nothing since file locking is not supported on this platform.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile does nothing since file locking is not supported on this platform.
+func unlockFile(f *os.File) error {
+	return nil
+}
+
+// syncDir does nothing on this platform.
+func syncDir(dir string) error {
+	return nil
+}
+
+// fileOwner always returns false since file ownership is not supported on this platform.
+func fileOwner(info fs.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// shellCommand returns a command that runs command using the shell.
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("sh", "-c", command)
+}
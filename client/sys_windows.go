@@ -0,0 +1,71 @@
+//go:build windows
+// +build windows
+
+package client
+
+import (
+	"io/fs"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+	// errorLockViolation is ERROR_LOCK_VIOLATION, returned when the lock is held by another process.
+	errorLockViolation syscall.Errno = 33
+)
+
+// lockFile acquires an exclusive lock on f without blocking.
+// If the lock is held by another process, errLockHeld is returned.
+func lockFile(f *os.File) error {
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(
+		f.Fd(),
+		lockfileExclusiveLock|lockfileFailImmediately,
+		0, // reserved
+		1, // lock the first byte
+		0,
+		uintptr(unsafe.Pointer(&ol)),
+	)
+	if r != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return errLockHeld
+	}
+	return err
+}
+
+// unlockFile releases the lock on f acquired by lockFile.
+func unlockFile(f *os.File) error {
+	var ol syscall.Overlapped
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// syncDir is a no-op on Windows since directories cannot be synced.
+func syncDir(dir string) error {
+	return nil
+}
+
+// fileOwner always returns false since file ownership is not supported on windows.
+func fileOwner(info fs.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// shellCommand returns a command that runs command using cmd.exe.
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
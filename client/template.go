@@ -0,0 +1,97 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// templateData is the data that is available to templated dotfiles.
+type templateData struct {
+	// OS is the current operating system, i.e. runtime.GOOS.
+	OS string
+	// Arch is the current architecture, i.e. runtime.GOARCH.
+	Arch     string
+	Hostname string
+	Username string
+	HomeDir  string
+	// Vars contains the variables from the registry merged with the local vars file.
+	Vars map[string]interface{}
+}
+
+// varsPath returns the path to the file containing local variables
+// that override the ones defined in the registry.
+func (c *Client) varsPath() string {
+	return filepath.Join(c.configPath(), "vars.yml")
+}
+
+// templateData returns the data used to render templates. It is only
+// computed the first time it is needed.
+func (c *Client) templateData() (*templateData, error) {
+	if c.tmplData != nil {
+		return c.tmplData, nil
+	}
+
+	vars := c.registry.Vars()
+	vp := c.varsPath()
+	f, err := os.Open(vp)
+	if err == nil {
+		defer f.Close()
+		var localVars map[string]interface{}
+		if err := yaml.NewDecoder(f).Decode(&localVars); err != nil {
+			return nil, fmt.Errorf("failed to decode vars file %s: %w", vp, err)
+		}
+		for k, v := range localVars {
+			vars[k] = v
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open vars file %s: %w", vp, err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+	c.tmplData = &templateData{
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Hostname: hostname,
+		Username: currentUsername(),
+		HomeDir:  c.homeDir,
+		Vars:     vars,
+	}
+	return c.tmplData, nil
+}
+
+// renderTemplate renders src which is the contents of the source file at srcPath.
+func (c *Client) renderTemplate(srcPath string, src []byte) ([]byte, error) {
+	data, err := c.templateData()
+	if err != nil {
+		return nil, err
+	}
+	// Error on missing keys so typos in variable names don't silently produce empty output
+	tmpl, err := template.New(srcPath).Option("missingkey=error").Parse(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template %q: %w", srcPath, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render template %q: %w", srcPath, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// currentUsername returns the username of the current user.
+// If it cannot be determined, the USER environment variable is used instead.
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
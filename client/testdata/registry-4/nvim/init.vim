@@ -0,0 +1,2 @@
+set number
+lua require("plugins")
@@ -0,0 +1,332 @@
+package client
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// transaction keeps track of changes made to the filesystem so that they can
+// be undone if an operation fails part way through. Before a file is modified,
+// a snapshot of its current state is taken so that it can be restored on rollback.
+type transaction struct {
+	snapshots []snapshot
+	// dirs is the list of directories created by the transaction in the order they were created.
+	dirs []string
+	// removedDirs is the list of directories removed by the transaction in the order they were removed.
+	removedDirs []removedDir
+	debugger    Debugger
+}
+
+// removedDir is a directory that was removed by a transaction.
+type removedDir struct {
+	path string
+	perm fs.FileMode
+}
+
+// snapshot represents the state of a file before it was modified by a transaction.
+type snapshot struct {
+	path   string
+	exists bool
+	data   []byte
+	mode   fs.FileMode
+	// linkTarget is the target of the symlink if the file was a symlink.
+	linkTarget string
+	// uid and gid are the owner of the file if hasOwner is true.
+	uid, gid int
+	hasOwner bool
+}
+
+func (s *snapshot) isSymlink() bool {
+	return s.mode&fs.ModeSymlink != 0
+}
+
+func newTransaction(debugger Debugger) *transaction {
+	return &transaction{debugger: debugger}
+}
+
+// snapshot records the current state of the file at path. Only the first snapshot of a
+// path is kept, since that is the state that needs to be restored on rollback.
+func (tx *transaction) snapshot(path string) error {
+	for _, s := range tx.snapshots {
+		if s.path == path {
+			return nil
+		}
+	}
+
+	s := snapshot{path: path}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		tx.snapshots = append(tx.snapshots, s)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get info of %q: %w", path, err)
+	}
+	s.exists = true
+	s.mode = info.Mode()
+	s.uid, s.gid, s.hasOwner = fileOwner(info)
+	switch {
+	case info.Mode().IsRegular():
+		s.data, err = os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read file %q: %w", path, err)
+		}
+	case s.isSymlink():
+		s.linkTarget, err = os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink %q: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("%q is not a regular file or symlink", path)
+	}
+	tx.snapshots = append(tx.snapshots, s)
+	return nil
+}
+
+// mkdirAll is like os.MkdirAll but records any directories that are created
+// so they can be removed on rollback.
+func (tx *transaction) mkdirAll(dir string) error {
+	// Find all the directories that don't exist yet, starting from the deepest
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to get info of %q: %w", d, err)
+		}
+		missing = append(missing, d)
+		if parent := filepath.Dir(d); parent == d {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", dir, err)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		// Directories that the transaction removed already existed, so they are recreated on rollback instead
+		if tx.wasRemoved(missing[i]) {
+			continue
+		}
+		tx.dirs = append(tx.dirs, missing[i])
+	}
+	return nil
+}
+
+// wasRemoved returns whether or not the directory dir was removed by the transaction.
+func (tx *transaction) wasRemoved(dir string) bool {
+	for _, d := range tx.removedDirs {
+		if d.path == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFile writes data to the file at path, creating it and any missing parent
+// directories if needed. The previous state of the file is recorded first.
+// If path is a symlink, it is replaced with a regular file.
+func (tx *transaction) writeFile(path string, data []byte, perm fs.FileMode) error {
+	if err := tx.prepare(path); err != nil {
+		return err
+	}
+	return writeFile(path, data, perm)
+}
+
+// symlink creates a symlink at path that points to target, replacing any existing file.
+// The previous state of the file is recorded first.
+func (tx *transaction) symlink(target, path string) error {
+	if err := tx.prepare(path); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %q: %w", path, err)
+	}
+	if err := os.Symlink(target, path); err != nil {
+		return fmt.Errorf("failed to create symlink %q: %w", path, err)
+	}
+	return nil
+}
+
+// chown sets the owner of the file at path. A uid or gid of -1 is left unchanged.
+// The previous state of the file, including its owner, is recorded first.
+func (tx *transaction) chown(path string, uid, gid int) error {
+	if err := tx.snapshot(path); err != nil {
+		return err
+	}
+	if err := os.Lchown(path, uid, gid); err != nil {
+		return fmt.Errorf("failed to change owner of %q: %w", path, err)
+	}
+	return nil
+}
+
+// remove removes the file at path. The previous state of the file is recorded first.
+// It is not an error if path does not exist.
+func (tx *transaction) remove(path string) error {
+	if err := tx.snapshot(path); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %q: %w", path, err)
+	}
+	return nil
+}
+
+// removeEmptyDir removes the directory at dir if it is empty, recording it so it can be recreated
+// on rollback. It does nothing if dir does not exist, is not a directory, or is not empty.
+func (tx *transaction) removeEmptyDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get info of %q: %w", dir, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read directory %q: %w", dir, err)
+	}
+	if len(entries) > 0 {
+		return nil
+	}
+	if err := os.Remove(dir); err != nil {
+		return fmt.Errorf("failed to remove directory %q: %w", dir, err)
+	}
+	tx.removedDirs = append(tx.removedDirs, removedDir{path: dir, perm: info.Mode().Perm()})
+	return nil
+}
+
+// prepare gets path ready to be written to. It snapshots path, creates any missing
+// parent directories, and removes path if it is a symlink so that the file it points
+// to is not modified.
+func (tx *transaction) prepare(path string) error {
+	if err := tx.snapshot(path); err != nil {
+		return err
+	}
+	if err := tx.mkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return removeSymlink(path)
+}
+
+// rollback restores all files modified by the transaction to their original state
+// and removes any directories that were created. Snapshots are restored in reverse
+// order. rollback attempts to restore every file even if some fail.
+func (tx *transaction) rollback() error {
+	var errs []string
+	// Recreate removed directories first, parents are recreated before their children
+	for i := len(tx.removedDirs) - 1; i >= 0; i-- {
+		d := tx.removedDirs[i]
+		tx.debugger.Debugf("Rolling back removal of %s", d.path)
+		if err := os.Mkdir(d.path, d.perm); err != nil && !os.IsExist(err) {
+			errs = append(errs, err.Error())
+		}
+	}
+	for i := len(tx.snapshots) - 1; i >= 0; i-- {
+		s := tx.snapshots[i]
+		tx.debugger.Debugf("Rolling back changes to %s", s.path)
+		// Remove whatever is there now first, the file may have been replaced with a symlink
+		// in which case writing to it would modify the file it points to
+		err := os.Remove(s.path)
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if s.exists {
+			// Parent directories may have been removed
+			if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+		}
+		switch {
+		case !s.exists:
+			err = nil
+		case s.isSymlink():
+			err = os.Symlink(s.linkTarget, s.path)
+		default:
+			err = writeFile(s.path, s.data, s.mode.Perm())
+		}
+		if err == nil && s.exists {
+			err = restoreOwner(s)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for i := len(tx.dirs) - 1; i >= 0; i-- {
+		// Make sure it's still a directory, a file may have been restored in its place
+		if info, err := os.Lstat(tx.dirs[i]); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := os.Remove(tx.dirs[i]); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	tx.snapshots = nil
+	tx.dirs = nil
+	tx.removedDirs = nil
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to roll back changes: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// writeFile writes data to the file at path. If the file already exists its contents
+// are replaced and its mode is set to perm, unlike os.WriteFile which keeps the existing mode.
+func writeFile(path string, data []byte, perm fs.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("failed to open/create file %q: %w", path, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write file %q: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close file %q: %w", path, err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		return fmt.Errorf("failed to set mode of %q: %w", path, err)
+	}
+	return nil
+}
+
+// restoreOwner restores the owner recorded in s if the file is no longer owned by it,
+// since recreating the file makes it owned by the current user.
+func restoreOwner(s snapshot) error {
+	if !s.hasOwner {
+		return nil
+	}
+	info, err := os.Lstat(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to get info of %q: %w", s.path, err)
+	}
+	if uid, gid, ok := fileOwner(info); ok && uid == s.uid && gid == s.gid {
+		return nil
+	}
+	if err := os.Lchown(s.path, s.uid, s.gid); err != nil {
+		return fmt.Errorf("failed to change owner of %q: %w", s.path, err)
+	}
+	return nil
+}
+
+// removeSymlink removes path if it is a symlink. It does nothing if path is not a symlink.
+func removeSymlink(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get info of %q: %w", path, err)
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove symlink %q: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/cszatmary/dot/client"
+	"github.com/spf13/cobra"
+)
+
+func newAddCommand(c *container) *cobra.Command {
+	var addOpts client.AddOptions
+	addCmd := &cobra.Command{
+		Use:   "add <file>",
+		Args:  cobra.ExactArgs(1),
+		Short: "Start managing an existing file as a dotfile",
+		Long: `dot add copies an existing file into the registry and adds it to dot.yml,
+so that it is managed by dot. The file is considered in sync with the registry,
+so it does not need to be applied.
+
+By default the file is added to a directory named after the dotfile,
+ex: 'dot add ~/.tmux.conf --name tmux' adds it as tmux/tmux.conf.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !c.dotClient.IsSetup() {
+				return fmt.Errorf("dot has not been setup, run `dot setup` to set it up")
+			}
+			c.logger.Printf("Adding %s as dotfile %s", args[0], addOpts.Name)
+			if err := c.dotClient.Add(args[0], addOpts); err != nil {
+				return err
+			}
+			c.logger.Printf("Successfully added dotfile %s", addOpts.Name)
+			return nil
+		},
+	}
+	addCmd.Flags().StringVarP(&addOpts.Name, "name", "n", "", "The name of the dotfile (required)")
+	addCmd.Flags().StringVar(&addOpts.SrcPath, "src", "", "The path of the dotfile source within the registry")
+	addCmd.Flags().StringSliceVar(&addOpts.OS, "os", nil, "The operating systems the dotfile supports")
+	_ = addCmd.MarkFlagRequired("name")
+	return addCmd
+}
@@ -2,31 +2,90 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
+	"text/tabwriter"
 
+	"github.com/cszatmary/dot/client"
 	"github.com/spf13/cobra"
 )
 
 func newApplyCommand(c *container) *cobra.Command {
 	var applyOpts struct {
-		force bool
+		force            bool
+		merge            bool
+		prune            bool
+		dryRun           bool
+		ignoreHookErrors bool
 	}
 	applyCmd := &cobra.Command{
 		Use:   "apply [DOTFILES...]",
 		Args:  cobra.ArbitraryArgs,
 		Short: "Apply dotfile changes",
+		Long: `dot apply copies dotfiles from the registry to their destinations.
+
+If a dotfile was manually modified, it will not be applied and an error is returned.
+Use --force to overwrite the modifications, or --merge to merge them with the changes
+to the dotfile in the registry. If merging results in conflicts, nothing is applied.
+A backup is created of any modified dotfile before it is overwritten or merged.
+
+Dotfiles that were removed from the registry are reported as orphaned. Use --prune
+to remove them, unless they were manually modified in which case they are left alone.
+
+Hooks defined in the registry are run for dotfiles that changed. If a hook fails, all
+changes are rolled back. Use --ignore-hook-errors to keep going instead.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if !c.dotClient.IsSetup() {
 				return fmt.Errorf("dot has not been setup, run `dot setup` to set it up")
 			}
+			if applyOpts.force && applyOpts.merge {
+				return fmt.Errorf("--force and --merge cannot be used together")
+			}
+			opts := client.ApplyOptions{
+				Force:            applyOpts.force,
+				Merge:            applyOpts.merge,
+				Prune:            applyOpts.prune,
+				IgnoreHookErrors: applyOpts.ignoreHookErrors,
+			}
+			if applyOpts.dryRun {
+				actions, err := c.dotClient.Plan(opts, args...)
+				if err != nil {
+					return err
+				}
+				tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+				fmt.Fprintln(tw, "NAME\tACTION\tDESTINATION\tREASON")
+				for _, a := range actions {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", a.Name, a.Type, a.DstPath, a.Reason)
+				}
+				return tw.Flush()
+			}
 			c.logger.Printf("Applying changes to dotfiles")
-			err := c.dotClient.Apply(applyOpts.force, args...)
+			err := c.dotClient.Apply(opts, args...)
 			if err != nil {
 				return err
 			}
 			c.logger.Printf("Successfully applied changes to dotfiles")
+			if len(args) > 0 {
+				return nil
+			}
+			orphans, err := c.dotClient.Orphans()
+			if err != nil {
+				return err
+			}
+			if len(orphans) > 0 {
+				c.logger.Printf("The following dotfiles were removed from the registry: %s", strings.Join(orphans, ", "))
+				if !applyOpts.prune {
+					c.logger.Printf("Run 'dot apply --prune' to remove them")
+				} else {
+					c.logger.Printf("They could not be removed since they were manually modified, run 'dot forget' to stop managing them")
+				}
+			}
 			return nil
 		},
 	}
 	applyCmd.Flags().BoolVarP(&applyOpts.force, "force", "f", false, "Overwrite dotfile if it was manually modified")
+	applyCmd.Flags().BoolVar(&applyOpts.merge, "merge", false, "Merge manual modifications with changes to the dotfile source")
+	applyCmd.Flags().BoolVar(&applyOpts.prune, "prune", false, "Remove dotfiles that were removed from the registry")
+	applyCmd.Flags().BoolVar(&applyOpts.ignoreHookErrors, "ignore-hook-errors", false, "Continue applying dotfiles if a hook fails")
+	applyCmd.Flags().BoolVar(&applyOpts.dryRun, "dry-run", false, "Show the actions that would be taken without applying any changes")
 	return applyCmd
 }
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+func newBackupsCommand(c *container) *cobra.Command {
+	backupsCmd := &cobra.Command{
+		Use:   "backups",
+		Args:  cobra.NoArgs,
+		Short: "Manage backups of dotfiles",
+		Long: `dot backups manages the backups that dot creates of dotfiles.
+
+A backup is created when a dotfile is setup, when a modified dotfile is
+overwritten by 'dot apply --force' or merged by 'dot apply --merge', and
+when a dotfile is overwritten by 'dot backups restore'. Only the most recent
+backups of each dotfile are kept, except for the backup created by 'dot setup'
+which is always kept.`,
+	}
+	backupsCmd.AddCommand(
+		newBackupsListCommand(c),
+		newBackupsRestoreCommand(c),
+		newBackupsShowCommand(c),
+	)
+	return backupsCmd
+}
+
+func newBackupsListCommand(c *container) *cobra.Command {
+	listCmd := &cobra.Command{
+		Use:     "list [DOTFILES...]",
+		Aliases: []string{"ls"},
+		Args:    cobra.ArbitraryArgs,
+		Short:   "List backups of dotfiles",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !c.dotClient.IsSetup() {
+				return fmt.Errorf("dot has not been setup, run `dot setup` to set it up")
+			}
+			backups, err := c.dotClient.Backups(args...)
+			if err != nil {
+				return err
+			}
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "NAME\tID\tTIME\tREASON")
+			for _, b := range backups {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", b.Name, b.ID, b.Time.Local().Format("2006-01-02 15:04:05"), b.Reason)
+			}
+			return tw.Flush()
+		},
+	}
+	return listCmd
+}
+
+func newBackupsShowCommand(c *container) *cobra.Command {
+	showCmd := &cobra.Command{
+		Use:   "show <dotfile> <id>",
+		Args:  cobra.ExactArgs(2),
+		Short: "Show the contents of a backup",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !c.dotClient.IsSetup() {
+				return fmt.Errorf("dot has not been setup, run `dot setup` to set it up")
+			}
+			backupPath, err := c.dotClient.BackupPath(args[0], args[1])
+			if err != nil {
+				return err
+			}
+			info, err := os.Lstat(backupPath)
+			if err != nil {
+				return fmt.Errorf("failed to get info of backup %s: %w", backupPath, err)
+			}
+			w := cmd.OutOrStdout()
+			if !info.IsDir() {
+				return showBackupFile(w, backupPath)
+			}
+			return filepath.WalkDir(backupPath, func(p string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(backupPath, p)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "==> %s <==\n", filepath.ToSlash(rel))
+				return showBackupFile(w, p)
+			})
+		},
+	}
+	return showCmd
+}
+
+// showBackupFile writes the contents of the backup file at p to w.
+// If p is a symlink, the symlink target is written instead.
+func showBackupFile(w io.Writer, p string) error {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return fmt.Errorf("failed to get info of %s: %w", p, err)
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(p)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink %s: %w", p, err)
+		}
+		fmt.Fprintf(w, "symlink to %s\n", target)
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", p, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("failed to read %s: %w", p, err)
+	}
+	return nil
+}
+
+func newBackupsRestoreCommand(c *container) *cobra.Command {
+	restoreCmd := &cobra.Command{
+		Use:   "restore <dotfile> <id>",
+		Args:  cobra.ExactArgs(2),
+		Short: "Restore a dotfile from a backup",
+		Long: `dot backups restore restores a dotfile to how it was when the given backup
+was created. A backup of the dotfile is created first so the restore can be undone.
+
+The dotfile remains managed by dot, so it will be considered manually modified
+until it is applied again.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !c.dotClient.IsSetup() {
+				return fmt.Errorf("dot has not been setup, run `dot setup` to set it up")
+			}
+			c.logger.Printf("Restoring backup %s of %s", args[1], args[0])
+			if err := c.dotClient.RestoreBackup(args[0], args[1]); err != nil {
+				return err
+			}
+			c.logger.Printf("Successfully restored backup")
+			return nil
+		},
+	}
+	return restoreCmd
+}
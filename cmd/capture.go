@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func newCaptureCommand(c *container) *cobra.Command {
+	captureCmd := &cobra.Command{
+		Use:   "capture [DOTFILES...]",
+		Args:  cobra.ArbitraryArgs,
+		Short: "Copy manual modifications of dotfiles back to the registry",
+		Long: `dot capture copies dotfiles that were manually modified back to their sources
+in the registry, so they are no longer considered modified.
+
+If no dotfiles are provided, all dotfiles that were manually modified will be captured.
+Templated dotfiles cannot be captured, the template must be updated in the registry instead.
+If the source of a dotfile has also changed, run 'dot apply --merge' before capturing it.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !c.dotClient.IsSetup() {
+				return fmt.Errorf("dot has not been setup, run `dot setup` to set it up")
+			}
+			c.logger.Printf("Capturing dotfiles")
+			if err := c.dotClient.Capture(args...); err != nil {
+				return err
+			}
+			c.logger.Printf("Successfully captured dotfiles")
+			return nil
+		},
+	}
+	return captureCmd
+}
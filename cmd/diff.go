@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cszatmary/dot/client"
+	"github.com/spf13/cobra"
+)
+
+// ANSI escape codes used to color diffs.
+const (
+	colorReset = "\x1b[0m"
+	colorBold  = "\x1b[1m"
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorCyan  = "\x1b[36m"
+)
+
+func newDiffCommand(c *container) *cobra.Command {
+	var diffOpts struct {
+		color bool
+		stat  bool
+	}
+	diffCmd := &cobra.Command{
+		Use:   "diff [DOTFILES...]",
+		Args:  cobra.ArbitraryArgs,
+		Short: "Show changes between dotfiles and their sources",
+		Long: `dot diff shows the changes that would be made to each dotfile if it was applied.
+Lines that are only in the dotfile source are shown as additions and lines that
+are only in the dotfile are shown as deletions.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !c.dotClient.IsSetup() {
+				return fmt.Errorf("dot has not been setup, run `dot setup` to set it up")
+			}
+			diffs, err := c.dotClient.Diff(args...)
+			if err != nil {
+				return err
+			}
+			if diffOpts.stat {
+				return writeDiffStat(cmd.OutOrStdout(), diffs, diffOpts.color)
+			}
+			for _, d := range diffs {
+				if d.Unified == "" {
+					continue
+				}
+				if !diffOpts.color {
+					fmt.Fprint(cmd.OutOrStdout(), d.Unified)
+					continue
+				}
+				fmt.Fprint(cmd.OutOrStdout(), colorizeDiff(d.Unified))
+			}
+			return nil
+		},
+	}
+	diffCmd.Flags().BoolVar(&diffOpts.color, "color", false, "Show colored diff")
+	diffCmd.Flags().BoolVar(&diffOpts.stat, "stat", false, "Show a summary of changes instead of the full diff")
+	return diffCmd
+}
+
+// colorizeDiff adds ANSI colors to each line of a unified diff.
+func colorizeDiff(unified string) string {
+	var sb strings.Builder
+	for _, line := range strings.SplitAfter(unified, "\n") {
+		if line == "" {
+			continue
+		}
+		var color string
+		switch {
+		case strings.HasPrefix(line, "---"), strings.HasPrefix(line, "+++"):
+			color = colorBold
+		case strings.HasPrefix(line, "@@"):
+			color = colorCyan
+		case strings.HasPrefix(line, "+"):
+			color = colorGreen
+		case strings.HasPrefix(line, "-"):
+			color = colorRed
+		}
+		if color == "" {
+			sb.WriteString(line)
+			continue
+		}
+		sb.WriteString(color)
+		sb.WriteString(strings.TrimSuffix(line, "\n"))
+		sb.WriteString(colorReset)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// writeDiffStat writes a summary of the number of lines changed in each dotfile,
+// similar to git diff --stat.
+func writeDiffStat(w io.Writer, diffs []client.DotfileDiff, color bool) error {
+	// Scale the graph down if there are lots of changes so lines don't get too long
+	const maxGraphWidth = 50
+	scale := 1.0
+	for _, d := range diffs {
+		if n := d.Insertions + d.Deletions; n > maxGraphWidth && float64(maxGraphWidth)/float64(n) < scale {
+			scale = float64(maxGraphWidth) / float64(n)
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 1, ' ', 0)
+	var changed, insertions, deletions int
+	for _, d := range diffs {
+		if d.Unified == "" {
+			continue
+		}
+		changed++
+		insertions += d.Insertions
+		deletions += d.Deletions
+		plus := strings.Repeat("+", scaleGraph(d.Insertions, scale))
+		minus := strings.Repeat("-", scaleGraph(d.Deletions, scale))
+		if color {
+			plus = colorGreen + plus + colorReset
+			minus = colorRed + minus + colorReset
+		}
+		fmt.Fprintf(tw, " %s\t| %d %s%s\n", d.Name, d.Insertions+d.Deletions, plus, minus)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, " %d dotfiles changed, %d insertions(+), %d deletions(-)\n", changed, insertions, deletions)
+	return err
+}
+
+// scaleGraph scales n by scale, making sure non-zero values are at least 1
+// so that they still show up in the graph.
+func scaleGraph(n int, scale float64) int {
+	scaled := int(float64(n) * scale)
+	if scaled == 0 && n > 0 {
+		return 1
+	}
+	return scaled
+}
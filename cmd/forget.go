@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/cszatmary/dot/client"
+	"github.com/spf13/cobra"
+)
+
+func newForgetCommand(c *container) *cobra.Command {
+	var forgetOpts client.ForgetOptions
+	forgetCmd := &cobra.Command{
+		Use:     "forget <DOTFILES...>",
+		Aliases: []string{"rm"},
+		Args:    cobra.MinimumNArgs(1),
+		Short:   "Stop managing dotfiles",
+		Long: `dot forget removes dotfiles from dot.yml and the lockfile so they are no longer managed by dot.
+
+By default the dotfile sources in the registry and the dotfiles themselves are left in place.
+Use --delete-source to also delete the sources from the registry, and --restore to restore
+the dotfiles to how they were before dot was setup, like 'dot restore' does.
+Dotfiles that were manually modified are not restored unless --force is provided.
+
+Dotfiles that were removed from dot.yml manually can also be forgotten to remove them from the lockfile.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !c.dotClient.IsSetup() {
+				return fmt.Errorf("dot has not been setup, run `dot setup` to set it up")
+			}
+			c.logger.Printf("Forgetting dotfiles")
+			if err := c.dotClient.Forget(forgetOpts, args...); err != nil {
+				return err
+			}
+			c.logger.Printf("Successfully forgot dotfiles")
+			return nil
+		},
+	}
+	forgetCmd.Flags().BoolVar(&forgetOpts.DeleteSource, "delete-source", false, "Delete the dotfile sources from the registry")
+	forgetCmd.Flags().BoolVar(&forgetOpts.Restore, "restore", false, "Restore the backups made when the dotfiles were setup")
+	forgetCmd.Flags().BoolVarP(&forgetOpts.Force, "force", "f", false, "Restore dotfiles even if they were manually modified")
+	return forgetCmd
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/cszatmary/dot/client"
+	"github.com/spf13/cobra"
+)
+
+func newPullCommand(c *container) *cobra.Command {
+	var pullOpts struct {
+		noApply bool
+		force   bool
+		merge   bool
+	}
+	pullCmd := &cobra.Command{
+		Use:     "pull",
+		Aliases: []string{"update"},
+		Args:    cobra.NoArgs,
+		Short:   "Pull the latest changes to the registry and apply them",
+		Long: `dot pull fetches the latest changes to the registry from its git remote, fast-forwards
+to them, and then applies dotfiles like 'dot apply' does.
+
+This only works if dot was setup with the URL of a git repository. If the registry has
+local commits that prevent fast-forwarding, nothing is changed and an error is returned.
+Use --no-apply to only update the registry.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !c.dotClient.IsSetup() {
+				return fmt.Errorf("dot has not been setup, run `dot setup` to set it up")
+			}
+			if pullOpts.force && pullOpts.merge {
+				return fmt.Errorf("--force and --merge cannot be used together")
+			}
+			c.logger.Printf("Pulling changes from %s", c.dotClient.Remote())
+			updated, err := c.dotClient.Pull()
+			if err != nil {
+				return err
+			}
+			if updated {
+				c.logger.Printf("Successfully pulled changes")
+			} else {
+				c.logger.Printf("Registry is already up to date")
+			}
+			if pullOpts.noApply {
+				return nil
+			}
+			c.logger.Printf("Applying changes to dotfiles")
+			err = c.dotClient.Apply(client.ApplyOptions{Force: pullOpts.force, Merge: pullOpts.merge})
+			if err != nil {
+				return err
+			}
+			c.logger.Printf("Successfully applied changes to dotfiles")
+			return nil
+		},
+	}
+	pullCmd.Flags().BoolVar(&pullOpts.noApply, "no-apply", false, "Only update the registry without applying dotfiles")
+	pullCmd.Flags().BoolVarP(&pullOpts.force, "force", "f", false, "Overwrite dotfile if it was manually modified")
+	pullCmd.Flags().BoolVar(&pullOpts.merge, "merge", false, "Merge manual modifications with changes to the dotfile source")
+	return pullCmd
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/cszatmary/dot/client"
+	"github.com/spf13/cobra"
+)
+
+func newRestoreCommand(c *container) *cobra.Command {
+	var restoreOpts struct {
+		all   bool
+		force bool
+	}
+	restoreCmd := &cobra.Command{
+		Use:     "restore [DOTFILES...]",
+		Aliases: []string{"unsetup"},
+		Args:    cobra.ArbitraryArgs,
+		Short:   "Restore dotfiles to how they were before dot was setup",
+		Long: `dot restore restores the given dotfiles to how they were before dot was setup
+using the backups that were created by 'dot setup'. If a dotfile did not exist
+before dot was setup, it will be deleted. The dotfiles will no longer be managed by dot.
+
+If a dotfile was manually modified, restoring it would lose the modifications, so an error
+is returned instead. Use --force to restore it anyway.
+
+If the --all flag is provided, all dotfiles will be restored and dot will be
+completely uninstalled, including removing all backups and any registry that
+was cloned or downloaded by dot.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !c.dotClient.IsSetup() {
+				return fmt.Errorf("dot has not been setup, run `dot setup` to set it up")
+			}
+			if restoreOpts.all {
+				if len(args) > 0 {
+					return fmt.Errorf("dotfile names cannot be provided when using --all")
+				}
+				c.logger.Printf("Restoring all dotfiles and uninstalling dot")
+				if err := c.dotClient.Uninstall(client.RestoreOptions{Force: restoreOpts.force}); err != nil {
+					return err
+				}
+				c.logger.Printf("Successfully uninstalled dot")
+				return nil
+			}
+			if len(args) == 0 {
+				return fmt.Errorf("no dotfiles provided, use --all to restore all dotfiles")
+			}
+			c.logger.Printf("Restoring dotfiles")
+			if err := c.dotClient.Restore(client.RestoreOptions{Force: restoreOpts.force}, args...); err != nil {
+				return err
+			}
+			c.logger.Printf("Successfully restored dotfiles")
+			return nil
+		},
+	}
+	restoreCmd.Flags().BoolVar(&restoreOpts.all, "all", false, "Restore all dotfiles and uninstall dot")
+	restoreCmd.Flags().BoolVarP(&restoreOpts.force, "force", "f", false, "Restore dotfiles even if they were manually modified")
+	return restoreCmd
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"runtime/debug"
+	"time"
 
 	"github.com/cszatmary/dot/client"
 	"github.com/cszatmary/dot/internal/log"
@@ -32,7 +33,8 @@ type container struct {
 	logger    *log.Logger
 	dotClient *client.Client
 	opts      struct {
-		verbose bool
+		verbose     bool
+		lockTimeout time.Duration
 	}
 }
 
@@ -58,19 +60,35 @@ func newRootCommand(c *container) *cobra.Command {
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			c.logger = log.New(os.Stderr)
 			c.logger.SetDebug(c.opts.verbose)
-			dotClient, err := client.New(client.WithDebugger(c.logger))
+			dotClient, err := client.New(
+				client.WithDebugger(c.logger),
+				client.WithLockTimeout(c.opts.lockTimeout),
+				client.WithHookOutput(os.Stderr),
+			)
 			if err != nil {
 				return fmt.Errorf("failed to setup dot: %w", err)
 			}
 			c.dotClient = dotClient
+			if dotClient.ArchiveChanged() {
+				c.logger.Printf("Warning: registry archive %s has changed since it was last applied", dotClient.Archive())
+			}
 			return nil
 		},
 	}
 	rootCmd.AddCommand(
+		newAddCommand(c),
 		newApplyCommand(c),
+		newBackupsCommand(c),
+		newCaptureCommand(c),
 		newCompletionsCommand(),
+		newDiffCommand(c),
+		newForgetCommand(c),
+		newPullCommand(c),
+		newRestoreCommand(c),
 		newSetupCommand(c),
+		newStatusCommand(c),
 	)
 	rootCmd.PersistentFlags().BoolVarP(&c.opts.verbose, "verbose", "v", false, "enable verbose output")
+	rootCmd.PersistentFlags().DurationVar(&c.opts.lockTimeout, "lock-timeout", 0, "how long to wait for another running dot process to finish")
 	return rootCmd
 }
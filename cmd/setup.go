@@ -1,21 +1,50 @@
 package cmd
 
 import (
+	"fmt"
+
+	"github.com/cszatmary/dot/client"
 	"github.com/spf13/cobra"
 )
 
 func newSetupCommand(c *container) *cobra.Command {
 	var setupOpts struct {
-		registryPath string
-		force        bool
+		registryPaths []string
+		force         bool
+		profile       string
 	}
 	setupCmd := &cobra.Command{
 		Use:   "setup",
 		Args:  cobra.NoArgs,
 		Short: "Setup dot to manage your dotfiles",
+		Long: `dot setup sets up dot to manage the dotfiles in a registry.
+
+If the registry defines profiles, --profile can be used to only manage the dotfiles
+in a profile. The profile is remembered, so commands like 'dot apply' only use the
+dotfiles in the profile when no dotfiles are provided.
+
+The registry can also be the URL of a git repository, ex: git@github.com:me/dotfiles.git.
+It is cloned into a directory managed by dot, use 'dot pull' to get the latest changes.
+
+The registry can also be the path or URL of a .zip, .tar.gz, or .tgz archive. Archives are
+read-only, and dot warns when the archive changes since it was last applied.
+
+--registry can be provided multiple times to layer registries on top of each other,
+ex: a shared team registry and a personal one. Dotfiles in later registries override
+dotfiles with the same name in earlier ones, and 'dot add' adds dotfiles to the last one.
+Every registry after the first must be a local directory. A registry can also layer
+itself on top of another by setting 'extends' in its dot.yml.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(setupOpts.registryPaths) == 0 {
+				return fmt.Errorf("a registry is required")
+			}
 			c.logger.Printf("Setting up dot...")
-			err := c.dotClient.Setup(setupOpts.registryPath, setupOpts.force)
+			err := c.dotClient.Setup(client.SetupOptions{
+				RegistryDir: setupOpts.registryPaths[0],
+				Layers:      setupOpts.registryPaths[1:],
+				Force:       setupOpts.force,
+				Profile:     setupOpts.profile,
+			})
 			if err != nil {
 				return err
 			}
@@ -23,7 +52,8 @@ func newSetupCommand(c *container) *cobra.Command {
 			return nil
 		},
 	}
-	setupCmd.Flags().StringVarP(&setupOpts.registryPath, "registry", "r", "~/.dotfiles", "path to directory where dotfile sources are located")
+	setupCmd.Flags().StringArrayVarP(&setupOpts.registryPaths, "registry", "r", []string{"~/.dotfiles"}, "path to directory, URL of git repository, or path or URL of archive where dotfile sources are located, can be repeated to layer registries")
 	setupCmd.Flags().BoolVarP(&setupOpts.force, "force", "f", false, "Re-setup dot with a new dotfiles source")
+	setupCmd.Flags().StringVarP(&setupOpts.profile, "profile", "p", "", "The profile of dotfiles to manage, defaults to all dotfiles")
 	return setupCmd
 }
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+func newStatusCommand(c *container) *cobra.Command {
+	statusCmd := &cobra.Command{
+		Use:   "status [DOTFILES...]",
+		Args:  cobra.ArbitraryArgs,
+		Short: "Show the status of dotfiles",
+		Long: `dot status shows the state of each dotfile managed by dot.
+
+The possible states are:
+	clean        the dotfile is up to date
+	modified     the dotfile was manually modified
+	outdated     the dotfile source has changed and needs to be applied
+	diverged     both the dotfile source and the dotfile were changed
+	missing      the dotfile does not exist and will be created when applied
+	not setup    the dotfile has not been setup, run 'dot setup' to set it up
+	unsupported  the dotfile is not supported on this machine, the reason is shown
+	orphaned     the dotfile was removed from the registry, run 'dot apply --prune' to remove it
+	drifted      the dotfile permissions or ownership differ from the registry, the reason is shown`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !c.dotClient.IsSetup() {
+				return fmt.Errorf("dot has not been setup, run `dot setup` to set it up")
+			}
+			statuses, err := c.dotClient.Status(args...)
+			if err != nil {
+				return err
+			}
+			layered := false
+			for _, s := range statuses {
+				if s.Layer != "" {
+					layered = true
+					break
+				}
+			}
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			if layered {
+				// Only show which layer each dotfile comes from when there are multiple
+				fmt.Fprintln(tw, "NAME\tSTATE\tDESTINATION\tLAYER\tREASON")
+				for _, s := range statuses {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.Name, s.State, s.DstPath, s.Layer, s.Reason)
+				}
+				return tw.Flush()
+			}
+			fmt.Fprintln(tw, "NAME\tSTATE\tDESTINATION\tREASON")
+			for _, s := range statuses {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Name, s.State, s.DstPath, s.Reason)
+			}
+			return tw.Flush()
+		},
+	}
+	return statusCmd
+}
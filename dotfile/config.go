@@ -0,0 +1,342 @@
+package dotfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFile is the name of the file containing the configuration of a registry.
+const ConfigFile = "dot.yml"
+
+// ErrExists is returned when a dotfile already exists.
+var ErrExists = errors.New("dotfile already exists")
+
+// AddToConfig adds df to the dotfiles in the config data, which must be the contents of a `dot.yml` file,
+// and returns the updated contents. The new dotfile is inserted after the existing ones and the rest of
+// the file is left as is, so comments, blank lines, and indentation are preserved. Only the src, dst,
+// and os fields of df are added. If a dotfile with the same name already exists, ErrExists is returned.
+func AddToConfig(data []byte, df Dotfile) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", ConfigFile, err)
+	}
+	if doc.Kind == 0 {
+		// Empty file
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: top level must be a map", ConfigFile)
+	}
+	key, dotfiles, next := mapEntry(root, "dotfiles")
+	if dotfiles != nil && dotfiles.Kind != yaml.MappingNode && dotfiles.Tag != "!!null" {
+		return nil, fmt.Errorf("%s: dotfiles must be a map", ConfigFile)
+	}
+	if dotfiles != nil && mapValue(dotfiles, df.Name) != nil {
+		return nil, fmt.Errorf("%w: %s", ErrExists, df.Name)
+	}
+
+	lines := splitLines(data)
+	unit := indentUnit(root)
+	if !canAddInPlace(lines, root, key, dotfiles) {
+		// Flow style maps and explicit nulls can't be edited in place, so the whole file is encoded again
+		value, err := encodeNode(df)
+		if err != nil {
+			return nil, err
+		}
+		if dotfiles == nil {
+			dotfiles = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "dotfiles"}, dotfiles)
+		} else if dotfiles.Kind == yaml.ScalarNode {
+			// 'dotfiles: ~'
+			*dotfiles = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		dotfiles.Content = append(dotfiles.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: df.Name}, value)
+		return encodeConfig(&doc, unit)
+	}
+	switch {
+	case dotfiles == nil:
+		entry, err := encodeEntry(df, strings.Repeat(" ", unit), unit)
+		if err != nil {
+			return nil, err
+		}
+		return insertLines(lines, len(lines), "dotfiles:\n"+entry), nil
+	case dotfiles.Kind == yaml.MappingNode && len(dotfiles.Content) > 0:
+		// Match the indentation of the existing dotfiles
+		first := dotfiles.Content[0]
+		if v := dotfiles.Content[1]; v.Kind == yaml.MappingNode && v.Style&yaml.FlowStyle == 0 && len(v.Content) > 0 {
+			unit = v.Content[0].Column - first.Column
+		}
+		entry, err := encodeEntry(df, strings.Repeat(" ", first.Column-1), unit)
+		if err != nil {
+			return nil, err
+		}
+		// Separate the dotfile with a blank line if the existing ones are separated that way
+		if n := len(dotfiles.Content); n > 2 {
+			if start := entryStart(lines, dotfiles.Content[n-2], key.Line); isBlank(lines[start-2]) {
+				entry = "\n" + entry
+			}
+		}
+		return insertLines(lines, contentEnd(lines, dotfiles, next), entry), nil
+	case dotfiles.Kind == yaml.MappingNode:
+		// 'dotfiles: {}', remove the braces so the dotfile can be added below the key
+		line := lines[key.Line-1]
+		open := dotfiles.Column - 1
+		end := open + strings.IndexByte(line[open:], '}')
+		lines[key.Line-1] = strings.TrimRight(line[:open], " ") + line[end+1:]
+	}
+	// 'dotfiles:' with no value
+	entry, err := encodeEntry(df, strings.Repeat(" ", key.Column-1+unit), unit)
+	if err != nil {
+		return nil, err
+	}
+	return insertLines(lines, key.Line, entry), nil
+}
+
+// RemoveFromConfig removes the dotfile with the given name from the config data, which must be the contents
+// of a `dot.yml` file, and returns the updated contents. Like AddToConfig, only the lines of the dotfile and
+// the comments above it are removed and the rest of the file is left as is. If the dotfile does not exist,
+// ErrNotFound is returned.
+func RemoveFromConfig(data []byte, name string) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", ConfigFile, err)
+	}
+	var root, key, dotfiles *yaml.Node
+	var next int
+	if doc.Kind == yaml.DocumentNode && doc.Content[0].Kind == yaml.MappingNode {
+		root = doc.Content[0]
+		key, dotfiles, next = mapEntry(root, "dotfiles")
+	}
+	if dotfiles == nil || dotfiles.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	i := 0
+	for ; i+1 < len(dotfiles.Content); i += 2 {
+		if dotfiles.Content[i].Value == name {
+			break
+		}
+	}
+	if i+1 >= len(dotfiles.Content) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if root.Style&yaml.FlowStyle != 0 || dotfiles.Style&yaml.FlowStyle != 0 {
+		// Flow style maps can't be edited in place, so the whole file is encoded again
+		dotfiles.Content = append(dotfiles.Content[:i], dotfiles.Content[i+2:]...)
+		return encodeConfig(&doc, indentUnit(root))
+	}
+
+	lines := splitLines(data)
+	start := entryStart(lines, dotfiles.Content[i], key.Line)
+	var end int
+	if i+2 < len(dotfiles.Content) {
+		// Keep the comments above the next dotfile
+		end = entryStart(lines, dotfiles.Content[i+2], key.Line) - 1
+	} else {
+		end = contentEnd(lines, dotfiles, next)
+		// Remove the blank lines separating the last dotfile from the one before it
+		for start-1 > key.Line && isBlank(lines[start-2]) {
+			start--
+		}
+	}
+	lines = append(lines[:start-1], lines[end:]...)
+	if len(dotfiles.Content) == 2 {
+		// Keep dotfiles a map now that it's empty
+		line := lines[key.Line-1]
+		colon := key.Column - 1 + len(key.Value)
+		colon += strings.IndexByte(line[colon:], ':')
+		lines[key.Line-1] = line[:colon+1] + " {}" + line[colon+1:]
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// mapValue returns the value of key in the mapping node n, or nil if n does not contain key.
+func mapValue(n *yaml.Node, key string) *yaml.Node {
+	_, v, _ := mapEntry(n, key)
+	return v
+}
+
+// mapEntry returns the key and value nodes of key in the mapping node n, along with the line
+// that the following key starts on. The line is 0 if key is the last key in n.
+// If n does not contain key, nil nodes are returned.
+func mapEntry(n *yaml.Node, key string) (*yaml.Node, *yaml.Node, int) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value != key {
+			continue
+		}
+		next := 0
+		if i+2 < len(n.Content) {
+			next = n.Content[i+2].Line
+		}
+		return n.Content[i], n.Content[i+1], next
+	}
+	return nil, nil, 0
+}
+
+// canAddInPlace returns whether or not a dotfile can be added to the dotfiles value
+// by inserting lines, rather than encoding the whole file again.
+func canAddInPlace(lines []string, root, key, dotfiles *yaml.Node) bool {
+	switch {
+	case root.Style&yaml.FlowStyle != 0:
+		return false
+	case dotfiles == nil || isImplicitNull(dotfiles) || isEmptyFlowMap(lines, key, dotfiles):
+		return true
+	}
+	return dotfiles.Kind == yaml.MappingNode && dotfiles.Style&yaml.FlowStyle == 0
+}
+
+// isImplicitNull returns whether or not n is a null value that was left empty, ex: 'dotfiles:'.
+func isImplicitNull(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && n.Tag == "!!null" && n.Value == ""
+}
+
+// isEmptyFlowMap returns whether or not value is an empty flow style map on the same line as key, ex: 'dotfiles: {}'.
+func isEmptyFlowMap(lines []string, key, value *yaml.Node) bool {
+	if value.Kind != yaml.MappingNode || len(value.Content) > 0 || value.Line != key.Line {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimLeft(lines[value.Line-1][value.Column:], " "), "}")
+}
+
+// indentUnit returns the number of spaces that nested maps are indented by in the top level map root.
+// It defaults to 2 if there are no nested maps.
+func indentUnit(root *yaml.Node) int {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		k, v := root.Content[i], root.Content[i+1]
+		if v.Kind == yaml.MappingNode && v.Style&yaml.FlowStyle == 0 && len(v.Content) > 0 && v.Content[0].Column > k.Column {
+			return v.Content[0].Column - k.Column
+		}
+	}
+	return 2
+}
+
+// encodeNode encodes df as the value of an entry in the dotfiles map.
+func encodeNode(df Dotfile) (*yaml.Node, error) {
+	var value yaml.Node
+	err := value.Encode(struct {
+		SrcPath string   `yaml:"src"`
+		DstPath string   `yaml:"dst"`
+		OS      []string `yaml:"os,omitempty"`
+	}{df.SrcPath, df.DstPath, df.OS})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode dotfile %s: %w", df.Name, err)
+	}
+	return &value, nil
+}
+
+// encodeEntry encodes df as an entry in the dotfiles map with each line prefixed by indent.
+// Nested values are indented by unit spaces.
+func encodeEntry(df Dotfile, indent string, unit int) (string, error) {
+	value, err := encodeNode(df)
+	if err != nil {
+		return "", err
+	}
+	entry := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: df.Name}, value,
+	}}
+	data, err := encodeConfig(&yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{entry}}, unit)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, line := range splitLines(data) {
+		sb.WriteString(indent)
+		sb.WriteString(line)
+	}
+	return sb.String(), nil
+}
+
+// encodeConfig encodes doc with nested values indented by unit spaces.
+func encodeConfig(doc *yaml.Node, unit int) ([]byte, error) {
+	if unit < 2 {
+		unit = 2
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(unit)
+	if err := enc.Encode(doc); err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", ConfigFile, err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", ConfigFile, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// splitLines splits data into lines, each of which includes its trailing newline if it has one.
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n') + 1
+		if i == 0 {
+			i = len(data)
+		}
+		lines = append(lines, string(data[:i]))
+		data = data[i:]
+	}
+	return lines
+}
+
+// insertLines inserts text after the line with the given number, which starts at 1, and returns the result.
+func insertLines(lines []string, after int, text string) []byte {
+	var sb strings.Builder
+	for _, line := range lines[:after] {
+		sb.WriteString(line)
+	}
+	if after > 0 && !strings.HasSuffix(lines[after-1], "\n") {
+		sb.WriteString("\n")
+	}
+	sb.WriteString(text)
+	for _, line := range lines[after:] {
+		sb.WriteString(line)
+	}
+	return []byte(sb.String())
+}
+
+// entryStart returns the line that the map entry with the given key node starts on,
+// including any comments directly above it, but not the line min or any before it.
+func entryStart(lines []string, key *yaml.Node, min int) int {
+	start := key.Line
+	for start-1 > min && isComment(lines[start-2]) {
+		start--
+	}
+	return start
+}
+
+// contentEnd returns the number of the last line of the block node n, where next is the line that
+// the following key starts on or 0 if there isn't one. Trailing blank lines and comments are not
+// included, since they separate n from what comes after it.
+func contentEnd(lines []string, n *yaml.Node, next int) int {
+	end := len(lines)
+	if next > 0 {
+		end = next - 1
+	}
+	last := lastLine(n)
+	for end > last && (isBlank(lines[end-1]) || isComment(lines[end-1])) {
+		end--
+	}
+	return end
+}
+
+// lastLine returns the line that the last value in n starts on.
+func lastLine(n *yaml.Node) int {
+	line := n.Line
+	for _, c := range n.Content {
+		if l := lastLine(c); l > line {
+			line = l
+		}
+	}
+	return line
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func isComment(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "#")
+}
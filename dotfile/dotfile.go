@@ -5,9 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"os"
+	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"text/template"
 
 	"gopkg.in/yaml.v3"
 )
@@ -15,13 +19,32 @@ import (
 // ErrNotFound is returned when a dotfile is not found.
 var ErrNotFound = errors.New("dotfile not found")
 
+// ErrProfileNotFound is returned when a profile is not found.
+var ErrProfileNotFound = errors.New("profile not found")
+
+// Modes that determine how a dotfile is installed to its destination.
+const (
+	// ModeCopy means the dotfile source is copied to the destination.
+	ModeCopy = "copy"
+	// ModeSymlink means the destination is a symlink to the dotfile source.
+	ModeSymlink = "symlink"
+)
+
 // Dotfile represents a dotfile managed by a registry.
 type Dotfile struct {
 	// Name is the name of the dotfile used to uniquely identify it in the registry.
 	Name string `yaml:"-"`
 	// SrcPath is the path to the dotfile source within the registry.
 	// It must be relative and cannot start with '.' or '..'.
-	SrcPath string `yaml:"src"`
+	// It may be a file or a directory. If it is a directory, all the files within
+	// it are managed as part of the dotfile.
+	// If the dotfile has alternative sources, SrcPath is the one chosen for the current machine.
+	// It is empty if none of them match the current machine.
+	SrcPath string `yaml:"-"`
+	// Sources contains the alternative sources of the dotfile if src is a map instead of a path.
+	// The keys are either "default", an OS like "darwin", or "host:" followed by a hostname.
+	// The most specific source for the current machine is used as SrcPath.
+	Sources map[string]string `yaml:"-"`
 	// DstPath is the path dotfile on the OS filesystem.
 	// It must be absolute i.e. start with a slash.
 	// The one exception to this rule is it maybe start with '~/'.
@@ -30,11 +53,177 @@ type Dotfile struct {
 	// OS is a list of supported operating systems for this dotfile.
 	// If OS is empty, it is interpreted as all operating systems being supported.
 	OS []string `yaml:"os"`
+	// When contains additional conditions that the machine must meet for the dotfile to be used.
+	When When `yaml:"when"`
+	// Template is whether or not the source is a Go text/template that must be
+	// rendered before being written to the destination.
+	Template bool `yaml:"template"`
+	// Mode is how the dotfile is installed, either ModeCopy or ModeSymlink.
+	// If Mode is empty, the registry default is used. If the registry has no default,
+	// an empty Mode is equivalent to ModeCopy.
+	Mode string `yaml:"mode"`
+	// Ignore is a list of glob patterns for files to ignore if SrcPath is a directory.
+	// Patterns use the syntax of path.Match and are matched against both the path
+	// of each file relative to SrcPath and the file name.
+	Ignore []string `yaml:"ignore"`
+	// Prune is whether or not files that were removed from the source directory should
+	// also be removed from the destination directory when the dotfile is applied.
+	Prune bool `yaml:"prune"`
+	// Perm is the permissions to set on the destination, ex: 0600. If Perm is 0, the permissions
+	// of the source are used. If SrcPath is a directory, Perm is set on each file in it.
+	Perm fs.FileMode `yaml:"perm"`
+	// Owner is the user that should own the destination, either a username or a numeric ID.
+	// If empty, the owner is not changed. Changing the owner usually requires running as root.
+	Owner string `yaml:"owner"`
+	// Group is the group that should own the destination, either a group name or a numeric ID.
+	// If empty, the group is not changed.
+	Group string `yaml:"group"`
+	// Tags is a list of tags used to group dotfiles. Profiles select dotfiles by their tags.
+	// If Tags is empty, the dotfile is included in every profile.
+	Tags []string `yaml:"tags"`
+	// Hooks are commands that are run when the dotfile is changed by applying it.
+	Hooks Hooks `yaml:"hooks"`
+	// IsDir is whether or not SrcPath is a directory. It is set by the registry.
+	IsDir bool `yaml:"-"`
+	// Layer is the name of the layer the dotfile comes from if the registry is layered,
+	// otherwise it is empty. It is set by the registry.
+	Layer string `yaml:"-"`
+}
+
+// When contains conditions that must all be met for a dotfile to be used on a machine.
+// Each condition is a list of values and is met if any of the values match.
+// Empty conditions are always met.
+type When struct {
+	// Arch is a list of supported architectures, ex: amd64 or arm64.
+	Arch []string `yaml:"arch"`
+	// Hostname is a list of glob patterns that are matched against the hostname.
+	// Patterns use the syntax of path.Match.
+	Hostname []string `yaml:"hostname"`
+	// Distro is a list of Linux distributions, ex: ubuntu or fedora. They are matched against
+	// the ID and ID_LIKE fields of /etc/os-release, so debian also matches distributions based on it.
+	Distro []string `yaml:"distro"`
+	// Env is a list of environment variables, one of which must be set.
+	Env []string `yaml:"env"`
+	// Command is a list of commands, one of which must be found in PATH.
+	Command []string `yaml:"command"`
+}
+
+// Hooks contains commands that are run when dotfiles are applied. Hooks are only run
+// if a dotfile was actually changed.
+type Hooks struct {
+	// PreApply is a list of commands that are run before changes are applied.
+	PreApply Commands `yaml:"pre_apply"`
+	// PostApply is a list of commands that are run after changes are applied.
+	PostApply Commands `yaml:"post_apply"`
+}
+
+// Commands is a list of shell commands. In YAML it may be either a single command or a list of commands.
+type Commands []string
+
+// UnmarshalYAML decodes commands from YAML, allowing a single command to be used instead of a list.
+func (c *Commands) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*c = Commands{value.Value}
+		return nil
+	}
+	var cmds []string
+	if err := value.Decode(&cmds); err != nil {
+		return err
+	}
+	*c = cmds
+	return nil
+}
+
+// validate checks that none of the hook commands are empty.
+func (h Hooks) validate() error {
+	for _, cmds := range []Commands{h.PreApply, h.PostApply} {
+		for _, cmd := range cmds {
+			if strings.TrimSpace(cmd) == "" {
+				return errors.New("hooks cannot contain empty commands")
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalYAML decodes a dotfile from YAML. It is needed since src may either be a path or a map of sources.
+func (df *Dotfile) UnmarshalYAML(value *yaml.Node) error {
+	// Use a type without methods to prevent infinite recursion
+	type plain Dotfile
+	var raw struct {
+		plain `yaml:",inline"`
+		Src   yaml.Node `yaml:"src"`
+	}
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	*df = Dotfile(raw.plain)
+	switch raw.Src.Kind {
+	case 0:
+		// src is missing, will be caught by validation
+	case yaml.ScalarNode:
+		df.SrcPath = raw.Src.Value
+	case yaml.MappingNode:
+		df.Sources = make(map[string]string)
+		if err := raw.Src.Decode(&df.Sources); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("line %d: src must be a path or a map of sources", raw.Src.Line)
+	}
+	return nil
+}
+
+// SrcPaths returns all the source paths of the dotfile, including alternative sources
+// that are not used on the current machine.
+func (df Dotfile) SrcPaths() []string {
+	if df.Sources == nil {
+		return []string{df.SrcPath}
+	}
+	paths := make([]string, 0, len(df.Sources))
+	for _, p := range df.Sources {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// resolveSrc returns the most specific source in sources for a machine running goos
+// with the given hostname. A source for the hostname takes precedence over a source for
+// the OS, which takes precedence over the default source. An empty string is returned
+// if no source matches.
+func resolveSrc(sources map[string]string, goos, hostname string) string {
+	if src, ok := sources["host:"+hostname]; ok && hostname != "" {
+		return src
+	}
+	if src, ok := sources[goos]; ok {
+		return src
+	}
+	// macOS is supported as an alias for darwin
+	if src, ok := sources["macOS"]; ok && goos == "darwin" {
+		return src
+	}
+	return sources["default"]
+}
+
+// IsSymlink returns whether or not the dotfile is installed as a symlink.
+func (df Dotfile) IsSymlink() bool {
+	return df.Mode == ModeSymlink
 }
 
 // config represents a `dot.yml` file.
 type config struct {
 	Dotfiles map[string]Dotfile `yaml:"dotfiles"`
+	// Vars are variables that are made available to templated dotfiles.
+	Vars map[string]interface{} `yaml:"vars"`
+	// Mode is the default mode for dotfiles that don't specify one.
+	Mode string `yaml:"mode"`
+	// Profiles is a map of profile names to the tags of the dotfiles they include.
+	Profiles map[string][]string `yaml:"profiles"`
+	// Hooks are commands that are run once when applying if any dotfile was changed.
+	Hooks Hooks `yaml:"hooks"`
+	// Extends is the path to another registry that this registry is layered on top of.
+	Extends string `yaml:"extends"`
 }
 
 // Registry represents a dot registry.
@@ -43,13 +232,47 @@ type config struct {
 type Registry struct {
 	fs  fs.FS
 	cfg config
+	// layers are the layers of a layered registry in order, they are nil otherwise.
+	layers []Layer
+}
+
+// Layer is a registry that is part of a layered registry.
+type Layer struct {
+	// Name uniquely identifies the layer, ex: the directory of the registry.
+	Name     string
+	Registry *Registry
+}
+
+// RegistryOption is a function that configures how a registry is loaded.
+type RegistryOption func(*registryOptions)
+
+type registryOptions struct {
+	goos     string
+	hostname string
+}
+
+// WithMachine sets the OS and hostname of the machine that the registry is loaded for.
+// They are used to choose between alternative sources of dotfiles.
+// By default, the current OS and hostname are used.
+func WithMachine(goos, hostname string) RegistryOption {
+	return func(opts *registryOptions) {
+		opts.goos = goos
+		opts.hostname = hostname
+	}
 }
 
 // NewRegistry creates a new Registry object from fsys. fsys must contain
 // a `dot.yml` file that holds the configuration for the registry.
 // NewRegistry will read `dot.yml` and return an validation errors encountered.
-func NewRegistry(fsys fs.FS) (*Registry, error) {
-	const filename = "dot.yml"
+func NewRegistry(fsys fs.FS, opts ...RegistryOption) (*Registry, error) {
+	ro := registryOptions{goos: runtime.GOOS}
+	// An error can be ignored, it just means host specific sources won't be used
+	ro.hostname, _ = os.Hostname()
+	for _, opt := range opts {
+		opt(&ro)
+	}
+
+	const filename = ConfigFile
 	f, err := fsys.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file %s from registry: %w", filename, err)
@@ -62,21 +285,86 @@ func NewRegistry(fsys fs.FS) (*Registry, error) {
 		return nil, fmt.Errorf("failed to decode %s: %w", filename, err)
 	}
 
+	if !validMode(cfg.Mode) {
+		return nil, fmt.Errorf("%s: invalid mode %q, must be one of %s or %s", filename, cfg.Mode, ModeCopy, ModeSymlink)
+	}
+	if err := cfg.Hooks.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
 	// Validate and normalize dotfiles
 	var errs ErrorList
 	for n, df := range cfg.Dotfiles {
 		df.Name = n
+		if df.Mode == "" {
+			df.Mode = cfg.Mode
+		}
 		var msgs []string
-		// Validate SrcPath
-		if fs.ValidPath(df.SrcPath) {
-			_, err := fs.Stat(fsys, df.SrcPath)
+		if df.Sources != nil {
+			if len(df.Sources) == 0 {
+				msgs = append(msgs, "src must contain at least one source")
+			}
+			df.SrcPath = resolveSrc(df.Sources, ro.goos, ro.hostname)
+		}
+		// Validate SrcPath and any alternatives. They must all be the same type so that
+		// switching between them doesn't change how the dotfile is installed.
+		srcKinds := make(map[bool]bool)
+		for _, p := range df.SrcPaths() {
+			if !fs.ValidPath(p) {
+				if df.Sources == nil {
+					msgs = append(msgs, "src path is invalid")
+				} else {
+					msgs = append(msgs, fmt.Sprintf("src path %q is invalid", p))
+				}
+				continue
+			}
+			info, err := fs.Stat(fsys, p)
 			if errors.Is(err, fs.ErrNotExist) {
-				msgs = append(msgs, fmt.Sprintf("%q does not exist", df.SrcPath))
+				msgs = append(msgs, fmt.Sprintf("%q does not exist", p))
 			} else if err != nil {
-				msgs = append(msgs, fmt.Sprintf("failed to stat %q: %s", df.SrcPath, err))
+				msgs = append(msgs, fmt.Sprintf("failed to stat %q: %s", p, err))
+			} else {
+				df.IsDir = info.IsDir()
+				srcKinds[info.IsDir()] = true
+			}
+		}
+		if len(srcKinds) > 1 {
+			msgs = append(msgs, "alternative sources must either all be files or all be directories")
+		}
+
+		// Make sure templates can be parsed so errors are caught early instead of when applying
+		if df.Template && len(msgs) == 0 {
+			for _, p := range df.SrcPaths() {
+				alt := df
+				alt.SrcPath = p
+				if err := validateTemplates(fsys, alt); err != nil {
+					msgs = append(msgs, err.Error())
+				}
+			}
+		}
+		for _, pattern := range df.Ignore {
+			if _, err := path.Match(pattern, ""); err != nil {
+				msgs = append(msgs, fmt.Sprintf("invalid ignore pattern %q", pattern))
+			}
+		}
+		for _, pattern := range df.When.Hostname {
+			if _, err := path.Match(pattern, ""); err != nil {
+				msgs = append(msgs, fmt.Sprintf("invalid hostname pattern %q", pattern))
 			}
-		} else {
-			msgs = append(msgs, "src path is invalid")
+		}
+
+		if !validMode(df.Mode) {
+			msgs = append(msgs, fmt.Sprintf("invalid mode %q, must be one of %s or %s", df.Mode, ModeCopy, ModeSymlink))
+		} else if df.IsSymlink() && df.Template {
+			msgs = append(msgs, "templates cannot be installed as symlinks")
+		} else if df.IsSymlink() && (df.Perm != 0 || df.Owner != "" || df.Group != "") {
+			msgs = append(msgs, "perm, owner, and group cannot be set on dotfiles installed as symlinks")
+		}
+		if df.Perm&^fs.ModePerm != 0 {
+			msgs = append(msgs, fmt.Sprintf("invalid perm %#o, must be between 0 and 0777", uint32(df.Perm)))
+		}
+		if err := df.Hooks.validate(); err != nil {
+			msgs = append(msgs, err.Error())
 		}
 
 		// Validate DstPath. DstPath must be an absolute path (i.e. begin with `/`),
@@ -96,7 +384,67 @@ func NewRegistry(fsys fs.FS) (*Registry, error) {
 	if len(errs) > 0 {
 		return nil, errs
 	}
-	return &Registry{fsys, cfg}, nil
+	return &Registry{fs: fsys, cfg: cfg}, nil
+}
+
+// NewLayeredRegistry creates a registry that combines layers, which are given from lowest to highest.
+// Dotfiles in a higher layer override dotfiles with the same name in lower layers, and their Layer
+// field is set to the name of the layer they come from. Vars and profiles are merged the same way,
+// and the hooks of every layer are run from lowest to highest.
+func NewLayeredRegistry(layers ...Layer) (*Registry, error) {
+	if len(layers) == 0 {
+		return nil, errors.New("layered registry must have at least one layer")
+	}
+	cfg := config{
+		Dotfiles: make(map[string]Dotfile),
+		Vars:     make(map[string]interface{}),
+		Profiles: make(map[string][]string),
+	}
+	seen := make(map[string]bool)
+	for _, l := range layers {
+		if seen[l.Name] {
+			return nil, fmt.Errorf("duplicate layer %q", l.Name)
+		}
+		seen[l.Name] = true
+		if l.Registry.layers != nil {
+			return nil, fmt.Errorf("layer %q cannot be a layered registry", l.Name)
+		}
+		for n, df := range l.Registry.cfg.Dotfiles {
+			df.Layer = l.Name
+			cfg.Dotfiles[n] = df
+		}
+		for k, v := range l.Registry.cfg.Vars {
+			cfg.Vars[k] = v
+		}
+		for p, tags := range l.Registry.cfg.Profiles {
+			cfg.Profiles[p] = tags
+		}
+		cfg.Hooks.PreApply = append(cfg.Hooks.PreApply, l.Registry.cfg.Hooks.PreApply...)
+		cfg.Hooks.PostApply = append(cfg.Hooks.PostApply, l.Registry.cfg.Hooks.PostApply...)
+	}
+	return &Registry{cfg: cfg, layers: layers}, nil
+}
+
+// Extends returns the path to the registry that this registry extends, as written in `dot.yml`,
+// or an empty string if it doesn't extend one. It is always empty for a layered registry.
+func (r *Registry) Extends() string {
+	return r.cfg.Extends
+}
+
+// Layers returns the layers of a layered registry from lowest to highest,
+// or nil if the registry is not layered.
+func (r *Registry) Layers() []Layer {
+	return r.layers
+}
+
+// dotfileFS returns the filesystem containing the source of df.
+func (r *Registry) dotfileFS(df Dotfile) fs.FS {
+	for _, l := range r.layers {
+		if l.Name == df.Layer {
+			return l.Registry.fs
+		}
+	}
+	return r.fs
 }
 
 // Dotfiles returns a list of dotfiles contained in the registry.
@@ -130,19 +478,191 @@ func (r *Registry) Dotfiles(names ...string) ([]Dotfile, error) {
 	return dotfiles, nil
 }
 
+// DotfilesWithTags returns the dotfiles in the registry that have at least one of the given tags.
+// Dotfiles without any tags are always included. If no tags are provided, all dotfiles are returned.
+func (r *Registry) DotfilesWithTags(tags ...string) []Dotfile {
+	dotfiles, _ := r.Dotfiles()
+	if len(tags) == 0 {
+		return dotfiles
+	}
+	return filterTags(dotfiles, tags)
+}
+
+// filterTags returns the dotfiles that have no tags or have at least one of the given tags.
+func filterTags(dotfiles []Dotfile, tags []string) []Dotfile {
+	var filtered []Dotfile
+	for _, df := range dotfiles {
+		if len(df.Tags) == 0 || df.hasTag(tags) {
+			filtered = append(filtered, df)
+		}
+	}
+	return filtered
+}
+
+// hasTag checks whether df has any of the given tags.
+func (df Dotfile) hasTag(tags []string) bool {
+	for _, t := range df.Tags {
+		for _, tag := range tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Profiles returns the names of the profiles defined in the registry in sorted order.
+func (r *Registry) Profiles() []string {
+	profiles := make([]string, 0, len(r.cfg.Profiles))
+	for p := range r.cfg.Profiles {
+		profiles = append(profiles, p)
+	}
+	sort.Strings(profiles)
+	return profiles
+}
+
+// ProfileDotfiles returns the dotfiles included in the given profile, which are the dotfiles
+// that have one of the profile's tags or have no tags. If the profile does not exist,
+// ErrProfileNotFound is returned.
+func (r *Registry) ProfileDotfiles(profile string) ([]Dotfile, error) {
+	tags, ok := r.cfg.Profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrProfileNotFound, profile)
+	}
+	dotfiles, _ := r.Dotfiles()
+	return filterTags(dotfiles, tags), nil
+}
+
+// Hooks returns the hooks defined at the top level of the registry, which are run
+// once when applying if any dotfile was changed.
+func (r *Registry) Hooks() Hooks {
+	return r.cfg.Hooks
+}
+
+// Vars returns the variables defined in the registry that should be made available to templates.
+func (r *Registry) Vars() map[string]interface{} {
+	vars := make(map[string]interface{}, len(r.cfg.Vars))
+	for k, v := range r.cfg.Vars {
+		vars[k] = v
+	}
+	return vars
+}
+
 // OpenDotfile opens the dotfile and returns a fs.File allowing access to the data.
 func (r *Registry) OpenDotfile(name string) (fs.File, error) {
 	df, ok := r.cfg.Dotfiles[name]
 	if !ok {
 		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
 	}
-	f, err := r.fs.Open(df.SrcPath)
+	f, err := r.dotfileFS(df).Open(df.SrcPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file %s: %w", df.SrcPath, err)
 	}
 	return f, nil
 }
 
+// validMode checks if mode is a valid dotfile mode. An empty mode is considered valid.
+func validMode(mode string) bool {
+	return mode == "" || mode == ModeCopy || mode == ModeSymlink
+}
+
+// validateTemplates checks that all the source files of df are valid templates.
+func validateTemplates(fsys fs.FS, df Dotfile) error {
+	paths := []string{df.SrcPath}
+	if df.IsDir {
+		files, err := dotfileFiles(fsys, df)
+		if err != nil {
+			return err
+		}
+		paths = paths[:0]
+		for _, f := range files {
+			paths = append(paths, path.Join(df.SrcPath, f))
+		}
+	}
+	for _, p := range paths {
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %w", p, err)
+		}
+		if _, err := template.New(p).Parse(string(data)); err != nil {
+			return fmt.Errorf("invalid template: %w", err)
+		}
+	}
+	return nil
+}
+
+// dotfileFiles returns the paths of all the regular files in the source directory of df,
+// relative to the source directory. Files matching an ignore pattern are excluded.
+func dotfileFiles(fsys fs.FS, df Dotfile) ([]string, error) {
+	var files []string
+	err := fs.WalkDir(fsys, df.SrcPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == df.SrcPath {
+			return nil
+		}
+		rel := strings.TrimPrefix(p, df.SrcPath+"/")
+		if df.ignored(rel) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %q: %w", df.SrcPath, err)
+	}
+	return files, nil
+}
+
+// ignored checks whether the file at rel, which is relative to SrcPath, matches an ignore pattern.
+func (df Dotfile) ignored(rel string) bool {
+	for _, pattern := range df.Ignore {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// DotfileFiles returns the paths of all the files managed by the dotfile with the given name.
+// The paths are relative to the dotfile source directory and use '/' as the separator.
+// Files that match one of the dotfile's ignore patterns are excluded.
+// If the dotfile source is not a directory, DotfileFiles returns nil.
+func (r *Registry) DotfileFiles(name string) ([]string, error) {
+	df, ok := r.cfg.Dotfiles[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if !df.IsDir {
+		return nil, nil
+	}
+	return dotfileFiles(r.dotfileFS(df), df)
+}
+
+// OpenDotfileFile opens a file within the source directory of a dotfile.
+// rel is the path to the file relative to the source directory.
+func (r *Registry) OpenDotfileFile(name, rel string) (fs.File, error) {
+	df, ok := r.cfg.Dotfiles[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	p := path.Join(df.SrcPath, rel)
+	f, err := r.dotfileFS(df).Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", p, err)
+	}
+	return f, nil
+}
+
 // ValidationError represents a dotfile having failed validation.
 // It contains the dotfile name and a list of validation failure messages.
 type ValidationError struct {
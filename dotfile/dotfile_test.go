@@ -46,6 +46,164 @@ func TestNewRegistryValidationError(t *testing.T) {
 	}
 }
 
+func TestNewRegistryInvalidTemplate(t *testing.T) {
+	mfs := fstest.MapFS{
+		"dot.yml": {
+			Data: []byte(`dotfiles:
+  git:
+    src: git/gitconfig
+    dst: ~/.gitconfig
+    template: true
+`),
+		},
+		"git/gitconfig": {
+			Data: []byte("[user]\n\temail = {{ .Vars.email\n"),
+		},
+	}
+	_, err := dotfile.NewRegistry(mfs)
+	var errs dotfile.ErrorList
+	if !errors.As(err, &errs) {
+		t.Fatalf("got error %v with type %T, wanted a dotfiles.ErrorList", err, err)
+	}
+	if len(errs) != 1 {
+		t.Errorf("got %d errors, want 1", len(errs))
+	}
+}
+
+func TestNewRegistryMode(t *testing.T) {
+	mfs := fstest.MapFS{
+		"dot.yml": {
+			Data: []byte(`mode: symlink
+dotfiles:
+  git:
+    src: git/gitconfig
+    dst: ~/.gitconfig
+  vim:
+    src: vim/vimrc
+    dst: ~/.vimrc
+    mode: copy
+  zsh:
+    src: zsh/zshrc
+    dst: ~/.zshrc
+    mode: hardlink
+`),
+		},
+		"git/gitconfig": {Data: []byte("[user]\n")},
+		"vim/vimrc":     {Data: []byte("syntax on\n")},
+		"zsh/zshrc":     {Data: []byte("export EDITOR=vim\n")},
+	}
+	_, err := dotfile.NewRegistry(mfs)
+	var errs dotfile.ErrorList
+	if !errors.As(err, &errs) {
+		t.Fatalf("got error %v with type %T, wanted a dotfiles.ErrorList", err, err)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("got %d errors, want 1", len(errs))
+	}
+	var validationErr *dotfile.ValidationError
+	if !errors.As(errs[0], &validationErr) || validationErr.DotfileName != "zsh" {
+		t.Errorf("got error %v, want a *dotfile.ValidationError for zsh", errs[0])
+	}
+
+	// Fix the invalid mode and make sure the registry default is used
+	mfs["dot.yml"].Data = []byte(`mode: symlink
+dotfiles:
+  git:
+    src: git/gitconfig
+    dst: ~/.gitconfig
+  vim:
+    src: vim/vimrc
+    dst: ~/.vimrc
+    mode: copy
+`)
+	registry, err := dotfile.NewRegistry(mfs)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	got, err := registry.Dotfiles()
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	want := []dotfile.Dotfile{
+		{Name: "git", SrcPath: "git/gitconfig", DstPath: "~/.gitconfig", Mode: dotfile.ModeSymlink},
+		{Name: "vim", SrcPath: "vim/vimrc", DstPath: "~/.vimrc", Mode: dotfile.ModeCopy},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got dotfiles %v, want %v", got, want)
+	}
+}
+
+func TestRegistryDotfileFiles(t *testing.T) {
+	mfs := fstest.MapFS{
+		"dot.yml": {
+			Data: []byte(`dotfiles:
+  nvim:
+    src: nvim
+    dst: ~/.config/nvim
+    ignore:
+      - "*.swp"
+      - plugged
+  zsh:
+    src: zsh/zshrc
+    dst: ~/.zshrc
+`),
+		},
+		"nvim/init.vim":             {Data: []byte("set number\n")},
+		"nvim/init.vim.swp":         {Data: []byte("swap\n")},
+		"nvim/lua/plugins.lua":      {Data: []byte("return {}\n")},
+		"nvim/plugged/foo/init.vim": {Data: []byte("\n")},
+		"zsh/zshrc":                 {Data: []byte("export EDITOR=vim\n")},
+	}
+	registry, err := dotfile.NewRegistry(mfs)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	got, err := registry.DotfileFiles("nvim")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	want := []string{"init.vim", "lua/plugins.lua"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got files %v, want %v", got, want)
+	}
+
+	got, err = registry.DotfileFiles("zsh")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if got != nil {
+		t.Errorf("got files %v, want nil for non-directory dotfile", got)
+	}
+}
+
+func TestRegistryVars(t *testing.T) {
+	mfs := fstest.MapFS{
+		"dot.yml": {
+			Data: []byte(`vars:
+  email: dev@example.com
+  work: true
+dotfiles:
+  git:
+    src: git/gitconfig
+    dst: ~/.gitconfig
+    template: true
+`),
+		},
+		"git/gitconfig": {
+			Data: []byte("[user]\n\temail = {{ .Vars.email }}\n"),
+		},
+	}
+	registry, err := dotfile.NewRegistry(mfs)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	got := registry.Vars()
+	want := map[string]interface{}{"email": "dev@example.com", "work": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got vars %v, want %v", got, want)
+	}
+}
+
 func TestRegistryDotfiles(t *testing.T) {
 	registry, err := dotfile.NewRegistry(createRegistryFixture())
 	if err != nil {
@@ -128,6 +286,587 @@ func TestRegistryOpenDotfileNotFound(t *testing.T) {
 	}
 }
 
+func TestRegistryProfiles(t *testing.T) {
+	mfs := fstest.MapFS{
+		"dot.yml": {
+			Data: []byte(`profiles:
+  work: [work, shell]
+  server: [shell]
+  minimal: []
+dotfiles:
+  git:
+    src: git/gitconfig
+    dst: ~/.gitconfig
+  ssh:
+    src: ssh/config
+    dst: ~/.ssh/config
+    tags: [work]
+  zsh:
+    src: zsh/zshrc
+    dst: ~/.zshrc
+    tags: [shell]
+`),
+		},
+		"git/gitconfig": {Data: []byte("[user]\n")},
+		"ssh/config":    {Data: []byte("Host *\n")},
+		"zsh/zshrc":     {Data: []byte("export EDITOR=vim\n")},
+	}
+	registry, err := dotfile.NewRegistry(mfs)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if got, want := registry.Profiles(), []string{"minimal", "server", "work"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got profiles %v, want %v", got, want)
+	}
+
+	names := func(dfs []dotfile.Dotfile) []string {
+		var names []string
+		for _, df := range dfs {
+			names = append(names, df.Name)
+		}
+		return names
+	}
+	tests := []struct {
+		profile string
+		want    []string
+	}{
+		{"work", []string{"git", "ssh", "zsh"}},
+		{"server", []string{"git", "zsh"}},
+		{"minimal", []string{"git"}},
+	}
+	for _, tt := range tests {
+		dfs, err := registry.ProfileDotfiles(tt.profile)
+		if err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+		if got := names(dfs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("profile %s: got dotfiles %v, want %v", tt.profile, got, tt.want)
+		}
+	}
+	if got, want := names(registry.DotfilesWithTags("work")), []string{"git", "ssh"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got dotfiles %v, want %v", got, want)
+	}
+	_, err = registry.ProfileDotfiles("personal")
+	if !errors.Is(err, dotfile.ErrProfileNotFound) {
+		t.Errorf("got %v, want dotfile.ErrProfileNotFound", err)
+	}
+}
+
+func TestNewRegistryAlternativeSources(t *testing.T) {
+	mfs := fstest.MapFS{
+		"dot.yml": {
+			Data: []byte(`dotfiles:
+  zsh:
+    src: {default: zsh/zshrc, darwin: zsh/zshrc.mac, host:build-box: zsh/zshrc.build}
+    dst: ~/.zshrc
+  git:
+    src:
+      linux: git/gitconfig
+    dst: ~/.gitconfig
+`),
+		},
+		"git/gitconfig":   {Data: []byte("[user]\n")},
+		"zsh/zshrc":       {Data: []byte("export EDITOR=vim\n")},
+		"zsh/zshrc.mac":   {Data: []byte("export EDITOR=vim\n")},
+		"zsh/zshrc.build": {Data: []byte("export EDITOR=vi\n")},
+	}
+	tests := []struct {
+		goos     string
+		hostname string
+		wantZsh  string
+		wantGit  string
+	}{
+		{"linux", "laptop", "zsh/zshrc", "git/gitconfig"},
+		{"darwin", "laptop", "zsh/zshrc.mac", ""},
+		{"darwin", "build-box", "zsh/zshrc.build", ""},
+	}
+	for _, tt := range tests {
+		registry, err := dotfile.NewRegistry(mfs, dotfile.WithMachine(tt.goos, tt.hostname))
+		if err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+		dfs, err := registry.Dotfiles("zsh", "git")
+		if err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+		if dfs[0].SrcPath != tt.wantZsh {
+			t.Errorf("%s/%s: got zsh src %q, want %q", tt.goos, tt.hostname, dfs[0].SrcPath, tt.wantZsh)
+		}
+		if dfs[1].SrcPath != tt.wantGit {
+			t.Errorf("%s/%s: got git src %q, want %q", tt.goos, tt.hostname, dfs[1].SrcPath, tt.wantGit)
+		}
+		wantPaths := []string{"zsh/zshrc", "zsh/zshrc.build", "zsh/zshrc.mac"}
+		if got := dfs[0].SrcPaths(); !reflect.DeepEqual(got, wantPaths) {
+			t.Errorf("got src paths %v, want %v", got, wantPaths)
+		}
+	}
+
+	// Every alternative must exist
+	delete(mfs, "zsh/zshrc.build")
+	_, err := dotfile.NewRegistry(mfs, dotfile.WithMachine("linux", "laptop"))
+	var errs dotfile.ErrorList
+	if !errors.As(err, &errs) {
+		t.Fatalf("got error %v with type %T, wanted a dotfiles.ErrorList", err, err)
+	}
+	if len(errs) != 1 {
+		t.Errorf("got %d errors, want 1: %v", len(errs), errs)
+	}
+}
+
+func TestNewRegistryPerm(t *testing.T) {
+	mfs := fstest.MapFS{
+		"dot.yml": {
+			Data: []byte(`dotfiles:
+  ssh:
+    src: ssh/config
+    dst: ~/.ssh/config
+    perm: 0600
+    owner: root
+  git:
+    src: git/gitconfig
+    dst: ~/.gitconfig
+    perm: 0o644
+`),
+		},
+		"git/gitconfig": {Data: []byte("[user]\n")},
+		"ssh/config":    {Data: []byte("Host *\n")},
+	}
+	registry, err := dotfile.NewRegistry(mfs)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	dfs, err := registry.Dotfiles("git", "ssh")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if dfs[0].Perm != 0o644 {
+		t.Errorf("got perm %#o, want %#o", dfs[0].Perm, 0o644)
+	}
+	if dfs[1].Perm != 0o600 || dfs[1].Owner != "root" {
+		t.Errorf("got perm %#o and owner %q, want %#o and %q", dfs[1].Perm, dfs[1].Owner, 0o600, "root")
+	}
+
+	mfs["dot.yml"] = &fstest.MapFile{Data: []byte(`mode: symlink
+dotfiles:
+  ssh:
+    src: ssh/config
+    dst: ~/.ssh/config
+    perm: 0600
+  git:
+    src: git/gitconfig
+    dst: ~/.gitconfig
+    perm: 01644
+    mode: copy
+`)}
+	_, err = dotfile.NewRegistry(mfs)
+	var errs dotfile.ErrorList
+	if !errors.As(err, &errs) {
+		t.Fatalf("got error %v with type %T, wanted a dotfiles.ErrorList", err, err)
+	}
+	if len(errs) != 2 {
+		t.Errorf("got %d errors, want 2: %v", len(errs), errs)
+	}
+}
+
+func TestNewRegistryHooks(t *testing.T) {
+	mfs := fstest.MapFS{
+		"dot.yml": {
+			Data: []byte(`hooks:
+  post_apply: echo applied
+dotfiles:
+  tmux:
+    src: tmux/tmux.conf
+    dst: ~/.tmux.conf
+    hooks:
+      pre_apply:
+        - echo before
+      post_apply:
+        - tmux source-file ~/.tmux.conf
+        - echo reloaded
+`),
+		},
+		"tmux/tmux.conf": {Data: []byte("set -g mouse on\n")},
+	}
+	registry, err := dotfile.NewRegistry(mfs)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	wantHooks := dotfile.Hooks{PostApply: dotfile.Commands{"echo applied"}}
+	if !reflect.DeepEqual(registry.Hooks(), wantHooks) {
+		t.Errorf("got registry hooks %+v, want %+v", registry.Hooks(), wantHooks)
+	}
+	dfs, err := registry.Dotfiles("tmux")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	wantHooks = dotfile.Hooks{
+		PreApply:  dotfile.Commands{"echo before"},
+		PostApply: dotfile.Commands{"tmux source-file ~/.tmux.conf", "echo reloaded"},
+	}
+	if !reflect.DeepEqual(dfs[0].Hooks, wantHooks) {
+		t.Errorf("got dotfile hooks %+v, want %+v", dfs[0].Hooks, wantHooks)
+	}
+
+	mfs["dot.yml"] = &fstest.MapFile{Data: []byte(`dotfiles:
+  tmux:
+    src: tmux/tmux.conf
+    dst: ~/.tmux.conf
+    hooks:
+      post_apply: ["  "]
+`)}
+	_, err = dotfile.NewRegistry(mfs)
+	var errs dotfile.ErrorList
+	if !errors.As(err, &errs) {
+		t.Fatalf("got error %v with type %T, wanted a dotfiles.ErrorList", err, err)
+	}
+	if len(errs) != 1 {
+		t.Errorf("got %d errors, want 1: %v", len(errs), errs)
+	}
+}
+
+func TestNewLayeredRegistry(t *testing.T) {
+	team, err := dotfile.NewRegistry(createRegistryFixture())
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	personal, err := dotfile.NewRegistry(fstest.MapFS{
+		"dot.yml": {
+			Data: []byte(`extends: ../team
+vars:
+  email: me@example.com
+dotfiles:
+  vim:
+    src: vimrc
+    dst: ~/.vimrc
+  tmux:
+    src: tmux.conf
+    dst: ~/.tmux.conf
+`),
+		},
+		"vimrc":     {Data: []byte("set number\n")},
+		"tmux.conf": {Data: []byte("set -g mouse on\n")},
+	})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if personal.Extends() != "../team" {
+		t.Errorf("got extends %q, want %q", personal.Extends(), "../team")
+	}
+
+	registry, err := dotfile.NewLayeredRegistry(
+		dotfile.Layer{Name: "team", Registry: team},
+		dotfile.Layer{Name: "personal", Registry: personal},
+	)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	got, err := registry.Dotfiles()
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	want := []dotfile.Dotfile{
+		{Name: "git", SrcPath: "git/gitconfig", DstPath: "~/.gitconfig", Layer: "team"},
+		{Name: "tmux", SrcPath: "tmux.conf", DstPath: "~/.tmux.conf", Layer: "personal"},
+		{Name: "vim", SrcPath: "vimrc", DstPath: "~/.vimrc", Layer: "personal"},
+		{Name: "zsh", SrcPath: "zsh/zshrc", DstPath: "~/.zshrc", Layer: "team"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got dotfiles %v, want %v", got, want)
+	}
+	wantVars := map[string]interface{}{"email": "me@example.com"}
+	if !reflect.DeepEqual(registry.Vars(), wantVars) {
+		t.Errorf("got vars %v, want %v", registry.Vars(), wantVars)
+	}
+
+	// Sources must be read from the layer the dotfile comes from
+	for name, want := range map[string]string{
+		"vim": "set number\n",
+		"zsh": `export PATH="$(go env GOPATH)/bin:$PATH"`,
+	} {
+		f, err := registry.OpenDotfile(name)
+		if err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+		if string(data) != want {
+			t.Errorf("got %s contents %q, want %q", name, data, want)
+		}
+	}
+
+	_, err = dotfile.NewLayeredRegistry(
+		dotfile.Layer{Name: "team", Registry: team},
+		dotfile.Layer{Name: "team", Registry: personal},
+	)
+	if err == nil {
+		t.Error("want error for duplicate layers, got nil")
+	}
+}
+
+func TestAddToConfig(t *testing.T) {
+	data := []byte(`# My dotfiles
+mode: copy
+dotfiles:
+  # Shell
+  zsh:
+    src: zsh/zshrc
+    dst: ~/.zshrc
+  git:
+    src: git/gitconfig # Global config
+    dst: ~/.gitconfig
+`)
+	got, err := dotfile.AddToConfig(data, dotfile.Dotfile{
+		Name:    "tmux",
+		SrcPath: "tmux/tmux.conf",
+		DstPath: "~/.tmux.conf",
+		OS:      []string{"linux"},
+	})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	want := `# My dotfiles
+mode: copy
+dotfiles:
+  # Shell
+  zsh:
+    src: zsh/zshrc
+    dst: ~/.zshrc
+  git:
+    src: git/gitconfig # Global config
+    dst: ~/.gitconfig
+  tmux:
+    src: tmux/tmux.conf
+    dst: ~/.tmux.conf
+    os:
+      - linux
+`
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestAddToConfigNoDotfiles(t *testing.T) {
+	got, err := dotfile.AddToConfig([]byte("dotfiles:\n"), dotfile.Dotfile{
+		Name:    "zsh",
+		SrcPath: "zsh/zshrc",
+		DstPath: "~/.zshrc",
+	})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	want := "dotfiles:\n  zsh:\n    src: zsh/zshrc\n    dst: ~/.zshrc\n"
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestAddToConfigExists(t *testing.T) {
+	data, err := fs.ReadFile(createRegistryFixture(), "dot.yml")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	_, err = dotfile.AddToConfig(data, dotfile.Dotfile{Name: "vim", SrcPath: "vim/vimrc", DstPath: "~/.vimrc"})
+	if !errors.Is(err, dotfile.ErrExists) {
+		t.Errorf("got %v, want dotfile.ErrExists", err)
+	}
+}
+
+func TestRemoveFromConfig(t *testing.T) {
+	data := []byte(`# My dotfiles
+dotfiles:
+  # Shell
+  zsh:
+    src: zsh/zshrc
+    dst: ~/.zshrc
+  git:
+    src: git/gitconfig
+    dst: ~/.gitconfig
+  vim:
+    src: vim/vimrc # Also used by neovim
+    dst: ~/.vimrc
+`)
+	got, err := dotfile.RemoveFromConfig(data, "git")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	want := `# My dotfiles
+dotfiles:
+  # Shell
+  zsh:
+    src: zsh/zshrc
+    dst: ~/.zshrc
+  vim:
+    src: vim/vimrc # Also used by neovim
+    dst: ~/.vimrc
+`
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	_, err = dotfile.RemoveFromConfig(data, "tmux")
+	if !errors.Is(err, dotfile.ErrNotFound) {
+		t.Errorf("got %v, want dotfile.ErrNotFound", err)
+	}
+}
+
+// spacedConfig is a `dot.yml` that uses blank lines between dotfiles and 4 space indentation.
+const spacedConfig = `# My dotfiles
+mode: copy
+
+dotfiles:
+    # Shell
+    zsh:
+        src: zsh/zshrc
+        dst: ~/.zshrc
+
+    git:
+        src: git/gitconfig
+        dst: ~/.gitconfig
+
+    # Editor
+    vim:
+        src: vim/vimrc
+        dst: ~/.vimrc
+
+vars:
+    email: me@example.com
+`
+
+func TestAddToConfigFormatting(t *testing.T) {
+	got, err := dotfile.AddToConfig([]byte(spacedConfig), dotfile.Dotfile{
+		Name:    "tmux",
+		SrcPath: "tmux/tmux.conf",
+		DstPath: "~/.tmux.conf",
+		OS:      []string{"linux"},
+	})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	want := `# My dotfiles
+mode: copy
+
+dotfiles:
+    # Shell
+    zsh:
+        src: zsh/zshrc
+        dst: ~/.zshrc
+
+    git:
+        src: git/gitconfig
+        dst: ~/.gitconfig
+
+    # Editor
+    vim:
+        src: vim/vimrc
+        dst: ~/.vimrc
+
+    tmux:
+        src: tmux/tmux.conf
+        dst: ~/.tmux.conf
+        os:
+            - linux
+
+vars:
+    email: me@example.com
+`
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	got, err = dotfile.AddToConfig([]byte("dotfiles: {} # None yet\n"), dotfile.Dotfile{
+		Name:    "zsh",
+		SrcPath: "zsh/zshrc",
+		DstPath: "~/.zshrc",
+	})
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	want = "dotfiles: # None yet\n  zsh:\n    src: zsh/zshrc\n    dst: ~/.zshrc\n"
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRemoveFromConfigFormatting(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"zsh", `# My dotfiles
+mode: copy
+
+dotfiles:
+    git:
+        src: git/gitconfig
+        dst: ~/.gitconfig
+
+    # Editor
+    vim:
+        src: vim/vimrc
+        dst: ~/.vimrc
+
+vars:
+    email: me@example.com
+`},
+		{"git", `# My dotfiles
+mode: copy
+
+dotfiles:
+    # Shell
+    zsh:
+        src: zsh/zshrc
+        dst: ~/.zshrc
+
+    # Editor
+    vim:
+        src: vim/vimrc
+        dst: ~/.vimrc
+
+vars:
+    email: me@example.com
+`},
+		{"vim", `# My dotfiles
+mode: copy
+
+dotfiles:
+    # Shell
+    zsh:
+        src: zsh/zshrc
+        dst: ~/.zshrc
+
+    git:
+        src: git/gitconfig
+        dst: ~/.gitconfig
+
+vars:
+    email: me@example.com
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dotfile.RemoveFromConfig([]byte(spacedConfig), tt.name)
+			if err != nil {
+				t.Fatalf("want nil error, got %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+
+	// Removing the last dotfile should leave an empty map
+	got, err := dotfile.RemoveFromConfig([]byte("dotfiles:\n  zsh:\n    src: zsh/zshrc\n    dst: ~/.zshrc\nvars:\n  a: b\n"), "zsh")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if want := "dotfiles: {}\nvars:\n  a: b\n"; string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
 func createRegistryFixture() fs.FS {
 	return fstest.MapFS{
 		"dot.yml": {
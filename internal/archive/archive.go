@@ -0,0 +1,142 @@
+// Package archive provides read-only filesystems backed by archive files.
+// Zip files and gzipped tar files are supported.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// extensions are the file extensions of the supported archive formats.
+var extensions = []string{".zip", ".tar.gz", ".tgz"}
+
+// IsArchive reports whether name has the extension of a supported archive format.
+func IsArchive(name string) bool {
+	return Ext(name) != ""
+}
+
+// Ext returns the extension of the archive format of name, or an empty string if it is not a supported archive.
+func Ext(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range extensions {
+		if strings.HasSuffix(lower, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// New returns a filesystem containing the files in data, which is the contents of the archive
+// file name. The format of the archive is determined by the extension of name.
+//
+// If the archive only contains a single directory at the top level, the filesystem is rooted
+// at that directory, since archives are commonly created that way.
+func New(name string, data []byte) (fs.FS, error) {
+	var zr *zip.Reader
+	var err error
+	switch Ext(name) {
+	case ".zip":
+		zr, err = zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err == nil {
+			err = checkZip(zr)
+		}
+	case ".tar.gz", ".tgz":
+		zr, err = tarToZip(data)
+	default:
+		return nil, fmt.Errorf("%s: unsupported archive format, must be one of %s", name, strings.Join(extensions, ", "))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive %s: %w", name, err)
+	}
+
+	entries, err := fs.ReadDir(zr, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive %s: %w", name, err)
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		return fs.Sub(zr, entries[0].Name())
+	}
+	return zr, nil
+}
+
+// checkZip returns an error if zr contains anything other than regular files and directories,
+// the same as what tarToZip allows. Otherwise links would be read as files containing their target.
+func checkZip(zr *zip.Reader) error {
+	for _, f := range zr.File {
+		mode := f.Mode()
+		if mode&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%s: links are not supported in registry archives", f.Name)
+		}
+		if !mode.IsRegular() && !mode.IsDir() {
+			return fmt.Errorf("%s: only regular files and directories are supported", f.Name)
+		}
+	}
+	return nil
+}
+
+// tarToZip converts the gzipped tar archive in data to a zip archive, since archive/zip
+// already provides a filesystem for zip archives. Files are stored without compression.
+func tarToZip(data []byte) (*zip.Reader, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if name == "." {
+			continue
+		}
+		if !fs.ValidPath(name) {
+			return nil, fmt.Errorf("%s: invalid path", hdr.Name)
+		}
+
+		zh := &zip.FileHeader{Name: name, Method: zip.Store, Modified: hdr.ModTime}
+		switch hdr.Typeflag {
+		case tar.TypeXGlobalHeader:
+			// Metadata for the whole archive, ex: the commit written by git archive
+			continue
+		case tar.TypeSymlink, tar.TypeLink:
+			return nil, fmt.Errorf("%s: links are not supported in registry archives", hdr.Name)
+		case tar.TypeDir:
+			zh.Name += "/"
+			zh.SetMode(fs.ModeDir | fs.FileMode(hdr.Mode).Perm())
+		case tar.TypeReg:
+			zh.SetMode(fs.FileMode(hdr.Mode).Perm())
+		default:
+			return nil, fmt.Errorf("%s: only regular files and directories are supported", hdr.Name)
+		}
+		w, err := zw.CreateHeader(zh)
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(w, tr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+}
@@ -0,0 +1,175 @@
+package archive_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/cszatmary/dot/internal/archive"
+)
+
+func TestIsArchive(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"dotfiles.zip", true},
+		{"dotfiles.tar.gz", true},
+		{"https://example.com/dotfiles-1.0.TGZ", true},
+		{"dotfiles.tar", false},
+		{"~/.dotfiles", false},
+	}
+	for _, tt := range tests {
+		if got := archive.IsArchive(tt.name); got != tt.want {
+			t.Errorf("IsArchive(%q) = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewTarGz(t *testing.T) {
+	data := newTarGz(t, []tarEntry{
+		{tar.Header{Name: "dotfiles/", Mode: 0o755, Typeflag: tar.TypeDir}, ""},
+		{tar.Header{Name: "dotfiles/dot.yml", Mode: 0o644, Typeflag: tar.TypeReg}, "dotfiles: {}\n"},
+		{tar.Header{Name: "dotfiles/ssh/config", Mode: 0o600, Typeflag: tar.TypeReg}, "Host *\n"},
+	})
+	fsys, err := archive.New("dotfiles.tar.gz", data)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if err := fstest.TestFS(fsys, "dot.yml", "ssh/config"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Stat(fsys, "ssh/config")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("got mode %#o, want %#o", info.Mode().Perm(), 0o600)
+	}
+}
+
+func TestNewTarGzGitArchive(t *testing.T) {
+	// git archive writes a pax global header containing the commit before any files
+	data := newTarGz(t, []tarEntry{
+		{tar.Header{
+			Name:       "pax_global_header",
+			Typeflag:   tar.TypeXGlobalHeader,
+			PAXRecords: map[string]string{"comment": "0123456789abcdef0123456789abcdef01234567"},
+		}, ""},
+		{tar.Header{Name: "dotfiles/", Mode: 0o755, Typeflag: tar.TypeDir}, ""},
+		{tar.Header{Name: "dotfiles/dot.yml", Mode: 0o644, Typeflag: tar.TypeReg}, "dotfiles: {}\n"},
+	})
+	fsys, err := archive.New("dotfiles.tar.gz", data)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if err := fstest.TestFS(fsys, "dot.yml"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewTarGzSymlink(t *testing.T) {
+	data := newTarGz(t, []tarEntry{
+		{tar.Header{Name: "dot.yml", Mode: 0o644, Typeflag: tar.TypeReg}, "dotfiles: {}\n"},
+		{tar.Header{Name: "zshrc", Typeflag: tar.TypeSymlink, Linkname: "dot.yml"}, ""},
+	})
+	_, err := archive.New("dotfiles.tar.gz", data)
+	if err == nil || !strings.Contains(err.Error(), "links are not supported") {
+		t.Errorf("got error %v, want links are not supported", err)
+	}
+}
+
+func TestNewZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range map[string]string{"dot.yml": "dotfiles: {}\n", "zsh/zshrc": "export EDITOR=vim\n"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	fsys, err := archive.New("dotfiles.zip", buf.Bytes())
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if err := fstest.TestFS(fsys, "dot.yml", "zsh/zshrc"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewZipSymlink(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("dot.yml")
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if _, err := w.Write([]byte("dotfiles: {}\n")); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	zh := &zip.FileHeader{Name: "zshrc"}
+	zh.SetMode(fs.ModeSymlink | 0o777)
+	w, err = zw.CreateHeader(zh)
+	if err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if _, err := w.Write([]byte("dot.yml")); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+
+	_, err = archive.New("dotfiles.zip", buf.Bytes())
+	if err == nil || !strings.Contains(err.Error(), "links are not supported") {
+		t.Errorf("got error %v, want links are not supported", err)
+	}
+}
+
+func TestNewUnsupported(t *testing.T) {
+	if _, err := archive.New("dotfiles.rar", nil); err == nil {
+		t.Error("want error, got nil")
+	}
+}
+
+type tarEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+// newTarGz returns a gzipped tar archive containing entries.
+func newTarGz(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatalf("want nil error, got %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("want nil error, got %v", err)
+	}
+	return buf.Bytes()
+}
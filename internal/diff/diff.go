@@ -0,0 +1,278 @@
+// Package diff provides line based diffing of text.
+// It can produce the list of edits between two texts as well
+// as format them as a unified diff.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Op is the type of operation an edit performs.
+type Op int
+
+const (
+	// OpEqual means the line is present in both texts.
+	OpEqual Op = iota
+	// OpInsert means the line was added in the new text.
+	OpInsert
+	// OpDelete means the line was removed from the old text.
+	OpDelete
+)
+
+// Edit is a single line operation required to turn one text into another.
+type Edit struct {
+	Op Op
+	// Line is the contents of the line. It includes the trailing newline if one is present.
+	Line string
+}
+
+// Lines splits s into lines. Each line retains its trailing newline.
+// The last line will not have a trailing newline if s does not end with one.
+func Lines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	// SplitAfter returns an empty string at the end if s ends with a newline
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Diff returns the shortest list of edits that turns a into b.
+// It uses the algorithm described in "An O(ND) Difference Algorithm and Its Variations" by Eugene Myers.
+func Diff(a, b []string) []Edit {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+
+	// v holds the furthest reaching x value for each diagonal k, offset by max
+	// so that negative diagonals can be indexed. trace holds a copy of v before
+	// each step so that the path can be reconstructed afterwards.
+	v := make([]int, 2*max+2)
+	var trace [][]int
+	var d int
+search:
+	for d = 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[max+k-1] < v[max+k+1]) {
+				x = v[max+k+1]
+			} else {
+				x = v[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[max+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk backwards through the trace to find the edits, then reverse them
+	var edits []Edit
+	x, y := n, m
+	for ; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[max+k-1] < v[max+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[max+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			edits = append(edits, Edit{OpEqual, a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			edits = append(edits, Edit{OpInsert, b[y-1]})
+		} else {
+			edits = append(edits, Edit{OpDelete, a[x-1]})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		edits = append(edits, Edit{OpEqual, a[x-1]})
+		x--
+		y--
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// Hunk is a group of edits that are close together along with the surrounding context.
+type Hunk struct {
+	// FromLine and ToLine are the 1-based line numbers where the hunk starts
+	// in the old and new text respectively.
+	FromLine, ToLine int
+	// FromCount and ToCount are the number of lines the hunk spans
+	// in the old and new text respectively.
+	FromCount, ToCount int
+	Edits              []Edit
+}
+
+// Hunks groups edits into hunks, keeping up to context lines of unchanged text
+// around each change. Changes separated by at most 2*context unchanged lines
+// are merged into a single hunk.
+func Hunks(edits []Edit, context int) []Hunk {
+	var hunks []Hunk
+	var h *Hunk
+	// Line numbers of the next line to be read in each text, 0-based
+	fromLine, toLine := 0, 0
+	for i := 0; i < len(edits); {
+		if edits[i].Op == OpEqual {
+			fromLine++
+			toLine++
+			i++
+			continue
+		}
+
+		// Found a change, start a new hunk with leading context
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		for start < i && edits[start].Op != OpEqual {
+			start++
+		}
+		hunks = append(hunks, Hunk{
+			FromLine: fromLine - (i - start) + 1,
+			ToLine:   toLine - (i - start) + 1,
+		})
+		h = &hunks[len(hunks)-1]
+		h.Edits = append(h.Edits, edits[start:i]...)
+		h.FromCount = i - start
+		h.ToCount = i - start
+
+		// Consume changes, continuing the hunk while the gap between changes is small
+		for i < len(edits) {
+			if edits[i].Op != OpEqual {
+				h.Edits = append(h.Edits, edits[i])
+				if edits[i].Op == OpDelete {
+					fromLine++
+					h.FromCount++
+				} else {
+					toLine++
+					h.ToCount++
+				}
+				i++
+				continue
+			}
+			// Count unchanged lines until the next change
+			j := i
+			for j < len(edits) && edits[j].Op == OpEqual {
+				j++
+			}
+			gap := j - i
+			if j < len(edits) && gap <= 2*context {
+				// Close enough to the next change, include the whole gap
+				h.Edits = append(h.Edits, edits[i:j]...)
+			} else {
+				// Add trailing context and end the hunk
+				if gap > context {
+					gap = context
+				}
+				h.Edits = append(h.Edits, edits[i:i+gap]...)
+				j = i + gap
+			}
+			n := j - i
+			h.FromCount += n
+			h.ToCount += n
+			fromLine += n
+			toLine += n
+			i = j
+			if j == len(edits) || edits[j].Op == OpEqual {
+				break
+			}
+		}
+	}
+	return hunks
+}
+
+// Stat holds the number of lines that were inserted and deleted by a list of edits.
+type Stat struct {
+	Insertions int
+	Deletions  int
+}
+
+// Stats counts the number of inserted and deleted lines in edits.
+func Stats(edits []Edit) Stat {
+	var s Stat
+	for _, e := range edits {
+		switch e.Op {
+		case OpInsert:
+			s.Insertions++
+		case OpDelete:
+			s.Deletions++
+		}
+	}
+	return s
+}
+
+// DefaultContext is the default number of unchanged lines shown around changes in a unified diff.
+const DefaultContext = 3
+
+// Unified returns a unified diff of the edits required to turn from into to.
+// fromName and toName are used as the names of the files in the diff header.
+// An empty string is returned if from and to are equal.
+func Unified(fromName, toName, from, to string) string {
+	return UnifiedEdits(fromName, toName, Diff(Lines(from), Lines(to)))
+}
+
+// UnifiedEdits is like Unified but formats a list of edits that was already computed using Diff.
+func UnifiedEdits(fromName, toName string, edits []Edit) string {
+	hunks := Hunks(edits, DefaultContext)
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n", fromName)
+	fmt.Fprintf(&sb, "+++ %s\n", toName)
+	for _, h := range hunks {
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(h.FromLine, h.FromCount), hunkRange(h.ToLine, h.ToCount))
+		for _, e := range h.Edits {
+			switch e.Op {
+			case OpEqual:
+				sb.WriteByte(' ')
+			case OpInsert:
+				sb.WriteByte('+')
+			case OpDelete:
+				sb.WriteByte('-')
+			}
+			sb.WriteString(e.Line)
+			if !strings.HasSuffix(e.Line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return sb.String()
+}
+
+// hunkRange formats a line range for a hunk header the same way GNU diff does.
+func hunkRange(line, count int) string {
+	switch count {
+	case 0:
+		// An empty range refers to the line before the hunk
+		return fmt.Sprintf("%d,0", line-1)
+	case 1:
+		return fmt.Sprintf("%d", line)
+	default:
+		return fmt.Sprintf("%d,%d", line, count)
+	}
+}
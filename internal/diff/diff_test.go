@@ -0,0 +1,205 @@
+package diff_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cszatmary/dot/internal/diff"
+)
+
+func TestDiff(t *testing.T) {
+	a := diff.Lines("a\nb\nc\nd\n")
+	b := diff.Lines("a\nc\nd\ne\n")
+	got := diff.Diff(a, b)
+	want := []diff.Edit{
+		{Op: diff.OpEqual, Line: "a\n"},
+		{Op: diff.OpDelete, Line: "b\n"},
+		{Op: diff.OpEqual, Line: "c\n"},
+		{Op: diff.OpEqual, Line: "d\n"},
+		{Op: diff.OpInsert, Line: "e\n"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got edits %v, want %v", got, want)
+	}
+	stat := diff.Stats(got)
+	if stat.Insertions != 1 || stat.Deletions != 1 {
+		t.Errorf("got stats %+v, want 1 insertion and 1 deletion", stat)
+	}
+}
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		to   string
+		want string
+	}{
+		{
+			name: "equal",
+			from: "a\nb\n",
+			to:   "a\nb\n",
+			want: "",
+		},
+		{
+			name: "new file",
+			from: "",
+			to:   "a\nb\n",
+			want: `--- from
++++ to
+@@ -0,0 +1,2 @@
++a
++b
+`,
+		},
+		{
+			name: "separate hunks",
+			from: "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			to:   "1\n2x\n3\n4\n5\n6\n7\n8\n9\n10\n11x\n12\n",
+			want: `--- from
++++ to
+@@ -1,5 +1,5 @@
+ 1
+-2
++2x
+ 3
+ 4
+ 5
+@@ -8,5 +8,5 @@
+ 8
+ 9
+ 10
+-11
++11x
+ 12
+`,
+		},
+		{
+			name: "merged hunks",
+			from: "1\n2\n3\n4\n5\n6\n7\n",
+			to:   "1\n2x\n3\n4\n5\n6x\n7\n",
+			want: `--- from
++++ to
+@@ -1,7 +1,7 @@
+ 1
+-2
++2x
+ 3
+ 4
+ 5
+-6
++6x
+ 7
+`,
+		},
+		{
+			name: "no trailing newline",
+			from: "a\nb",
+			to:   "a\nc",
+			want: `--- from
++++ to
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++c
+\ No newline at end of file
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diff.Unified("from", "to", tt.from, tt.to)
+			if got != tt.want {
+				t.Errorf("got diff\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffRoundTrip(t *testing.T) {
+	from := strings.Repeat("foo\nbar\nbaz\n", 20)
+	to := strings.ReplaceAll(from, "bar\n", "qux\nbar\n")
+	var a, b strings.Builder
+	for _, e := range diff.Diff(diff.Lines(from), diff.Lines(to)) {
+		if e.Op != diff.OpInsert {
+			a.WriteString(e.Line)
+		}
+		if e.Op != diff.OpDelete {
+			b.WriteString(e.Line)
+		}
+	}
+	if a.String() != from {
+		t.Errorf("edits do not reproduce old text")
+	}
+	if b.String() != to {
+		t.Errorf("edits do not reproduce new text")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name          string
+		base          string
+		a             string
+		b             string
+		want          string
+		wantConflicts int
+	}{
+		{
+			name: "no changes",
+			base: "a\nb\nc\n",
+			a:    "a\nb\nc\n",
+			b:    "a\nb\nc\n",
+			want: "a\nb\nc\n",
+		},
+		{
+			name: "only a changed",
+			base: "a\nb\nc\n",
+			a:    "a\nB\nc\n",
+			b:    "a\nb\nc\n",
+			want: "a\nB\nc\n",
+		},
+		{
+			name: "separate changes",
+			base: "1\n2\n3\n4\n5\n6\n",
+			a:    "0\n1\n2x\n3\n4\n5\n6\n",
+			b:    "1\n2\n3\n4\n5x\n6\n7\n",
+			want: "0\n1\n2x\n3\n4\n5x\n6\n7\n",
+		},
+		{
+			name: "same change",
+			base: "a\nb\nc\n",
+			a:    "a\nx\nc\n",
+			b:    "a\nx\nc\n",
+			want: "a\nx\nc\n",
+		},
+		{
+			name:          "conflict",
+			base:          "a\nb\nc\n",
+			a:             "a\nx\nc\n",
+			b:             "a\ny\nc\n",
+			want:          "a\n<<<<<<< local\nx\n=======\ny\n>>>>>>> registry\nc\n",
+			wantConflicts: 1,
+		},
+		{
+			name:          "conflict without trailing newline",
+			base:          "a\nb",
+			a:             "a\nx",
+			b:             "a\ny",
+			want:          "a\n<<<<<<< local\nx\n=======\ny\n>>>>>>> registry\n",
+			wantConflicts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, conflicts := diff.Merge(diff.Lines(tt.base), diff.Lines(tt.a), diff.Lines(tt.b), "local", "registry")
+			if got := strings.Join(merged, ""); got != tt.want {
+				t.Errorf("got merged\n%s\nwant\n%s", got, tt.want)
+			}
+			if conflicts != tt.wantConflicts {
+				t.Errorf("got %d conflicts, want %d", conflicts, tt.wantConflicts)
+			}
+		})
+	}
+}
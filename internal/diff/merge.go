@@ -0,0 +1,147 @@
+package diff
+
+import "strings"
+
+// Conflict markers used by Merge. They are followed by the name of the text.
+const (
+	ConflictStart = "<<<<<<<"
+	ConflictSep   = "======="
+	ConflictEnd   = ">>>>>>>"
+)
+
+// change is a contiguous region of lines in the base text that were replaced.
+type change struct {
+	// start and end are the range of lines [start, end) in the base text that were replaced.
+	// They are equal if lines were only inserted.
+	start, end int
+	lines      []string
+}
+
+// changes converts edits into the list of regions that were changed in the old text.
+func changes(edits []Edit) []change {
+	var cs []change
+	var cur *change
+	i := 0
+	for _, e := range edits {
+		if e.Op == OpEqual {
+			if cur != nil {
+				cs = append(cs, *cur)
+				cur = nil
+			}
+			i++
+			continue
+		}
+		if cur == nil {
+			cur = &change{start: i, end: i}
+		}
+		if e.Op == OpDelete {
+			cur.end++
+			i++
+		} else {
+			cur.lines = append(cur.lines, e.Line)
+		}
+	}
+	if cur != nil {
+		cs = append(cs, *cur)
+	}
+	return cs
+}
+
+// Merge performs a three-way merge of the changes made to base in a and in b.
+// Changes that only one side made are applied. If both sides changed the same region
+// of base differently, it is a conflict and both versions are included between conflict
+// markers labeled with aName and bName. The merged lines and the number of conflicts are returned.
+//
+// Changes that are adjacent to each other are considered overlapping, like in diff3.
+func Merge(base, a, b []string, aName, bName string) ([]string, int) {
+	ca := changes(Diff(base, a))
+	cb := changes(Diff(base, b))
+	var merged []string
+	conflicts := 0
+	pos := 0
+	for len(ca) > 0 || len(cb) > 0 {
+		// Start a chunk with whichever change comes first and then keep
+		// adding changes from both sides as long as they overlap it
+		var lo int
+		if len(cb) == 0 || (len(ca) > 0 && ca[0].start <= cb[0].start) {
+			lo = ca[0].start
+		} else {
+			lo = cb[0].start
+		}
+		hi := lo
+		var chunkA, chunkB []change
+		for {
+			n := len(chunkA) + len(chunkB)
+			for len(ca) > 0 && ca[0].start <= hi {
+				if ca[0].end > hi {
+					hi = ca[0].end
+				}
+				chunkA = append(chunkA, ca[0])
+				ca = ca[1:]
+			}
+			for len(cb) > 0 && cb[0].start <= hi {
+				if cb[0].end > hi {
+					hi = cb[0].end
+				}
+				chunkB = append(chunkB, cb[0])
+				cb = cb[1:]
+			}
+			if len(chunkA)+len(chunkB) == n {
+				break
+			}
+		}
+
+		merged = append(merged, base[pos:lo]...)
+		linesA := applyChanges(base, lo, hi, chunkA)
+		linesB := applyChanges(base, lo, hi, chunkB)
+		switch {
+		case len(chunkB) == 0:
+			merged = append(merged, linesA...)
+		case len(chunkA) == 0, equalLines(linesA, linesB):
+			merged = append(merged, linesB...)
+		default:
+			conflicts++
+			merged = appendConflictLine(merged, ConflictStart+" "+aName)
+			merged = append(merged, linesA...)
+			merged = appendConflictLine(merged, ConflictSep)
+			merged = append(merged, linesB...)
+			merged = appendConflictLine(merged, ConflictEnd+" "+bName)
+		}
+		pos = hi
+	}
+	merged = append(merged, base[pos:]...)
+	return merged, conflicts
+}
+
+// applyChanges returns the lines in the range [lo, hi) of base after applying cs.
+// All changes in cs must be within the range.
+func applyChanges(base []string, lo, hi int, cs []change) []string {
+	var lines []string
+	pos := lo
+	for _, c := range cs {
+		lines = append(lines, base[pos:c.start]...)
+		lines = append(lines, c.lines...)
+		pos = c.end
+	}
+	return append(lines, base[pos:hi]...)
+}
+
+// appendConflictLine appends a conflict marker line to lines making sure it starts on its own line.
+func appendConflictLine(lines []string, marker string) []string {
+	if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+		lines[n-1] += "\n"
+	}
+	return append(lines, marker+"\n")
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}